@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Ryan-Har/adit/client/transfer"
+)
+
+// clientConfig holds the settings which can be given in the config file.
+// The top level of the file has the defaults, and each table under
+// profiles has a profile chosen with -profile whose settings replace them.
+//
+//	relay = "wss://adit.internal.example.com/ws"
+//	overwrite = "rename"
+//
+//	[profiles.work]
+//	output_dir = "~/Downloads/adit"
+//
+//	[[profiles.work.ice_servers]]
+//	urls = ["turn:turn.internal.example.com:3478"]
+//	username = "adit"
+//	credential = "secret"
+type clientConfig struct {
+	Relay string `toml:"relay"`
+	// ICEServers replace the default STUN servers when set
+	ICEServers []iceServer `toml:"ice_servers"`
+	OutputDir  string      `toml:"output_dir"`
+	ChunkSize  int         `toml:"chunk_size"`
+	Overwrite  string      `toml:"overwrite"`
+}
+
+type iceServer struct {
+	URLs       []string `toml:"urls"`
+	Username   string   `toml:"username"`
+	Credential string   `toml:"credential"`
+}
+
+type configFile struct {
+	clientConfig
+	Profiles map[string]clientConfig `toml:"profiles"`
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/adit/config.toml, or the
+// platform's equivalent
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "adit", "config.toml")
+}
+
+// loadConfig reads the config file at path with the settings of profile
+// applied. A missing file is only an error when required, as when the
+// path was given by the user.
+func loadConfig(path string, required bool, profile string) (clientConfig, error) {
+	var f configFile
+	if path != "" {
+		md, err := toml.DecodeFile(path, &f)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !required:
+		case err != nil:
+			return clientConfig{}, fmt.Errorf("unable to read config file %s: %w", path, err)
+		default:
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				return clientConfig{}, fmt.Errorf("unknown setting %s in config file %s", undecoded[0], path)
+			}
+		}
+	}
+
+	c := f.clientConfig
+	if profile != "" {
+		p, ok := f.Profiles[profile]
+		if !ok {
+			names := make([]string, 0, len(f.Profiles))
+			for name := range f.Profiles {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			err := fmt.Errorf("profile %q is not in the config file %s", profile, path)
+			if len(names) > 0 {
+				err = fmt.Errorf("%w, it has: %s", err, strings.Join(names, ", "))
+			}
+			return clientConfig{}, err
+		}
+		c = c.with(p)
+	}
+	return c, c.validate()
+}
+
+// with returns c with the settings made in the profile p replacing its own
+func (c clientConfig) with(p clientConfig) clientConfig {
+	if p.Relay != "" {
+		c.Relay = p.Relay
+	}
+	if p.ICEServers != nil {
+		c.ICEServers = p.ICEServers
+	}
+	if p.OutputDir != "" {
+		c.OutputDir = p.OutputDir
+	}
+	if p.ChunkSize != 0 {
+		c.ChunkSize = p.ChunkSize
+	}
+	if p.Overwrite != "" {
+		c.Overwrite = p.Overwrite
+	}
+	return c
+}
+
+func (c clientConfig) validate() error {
+	for _, s := range c.ICEServers {
+		if len(s.URLs) == 0 {
+			return errors.New("an ICE server in the config file has no urls")
+		}
+		for _, u := range s.URLs {
+			if (strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:")) && (s.Username == "" || s.Credential == "") {
+				return fmt.Errorf("the TURN server %s in the config file needs a username and credential", u)
+			}
+		}
+	}
+	return nil
+}
+
+func (c clientConfig) iceServers() []transfer.ICEServer {
+	var servers []transfer.ICEServer
+	for _, s := range c.ICEServers {
+		servers = append(servers, transfer.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential})
+	}
+	return servers
+}
+
+// configurable are the flags which can also be set with an environment
+// variable or in the config file, the flag takes precedence over the
+// environment and the environment over the file
+var configurable = []struct {
+	flag, env string
+	// value returns the setting from the config file, empty when not set
+	value func(c clientConfig) string
+}{
+	{"r", "ADIT_RELAY", func(c clientConfig) string { return c.Relay }},
+	{"s", "ADIT_STUN_SERVER", func(c clientConfig) string { return "" }},
+	{"o", "ADIT_OUTPUT_DIR", func(c clientConfig) string { return expandHome(c.OutputDir) }},
+	{"b", "ADIT_CHUNK_SIZE", func(c clientConfig) string {
+		if c.ChunkSize == 0 {
+			return ""
+		}
+		return strconv.Itoa(c.ChunkSize)
+	}},
+	{"overwrite", "ADIT_OVERWRITE", func(c clientConfig) string { return c.Overwrite }},
+}
+
+// applyConfig sets the configurable flags which were not given on the
+// command line from the environment or the config file
+func applyConfig(flags *flag.FlagSet, c clientConfig) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for _, s := range configurable {
+		if given[s.flag] {
+			continue
+		}
+		v, source := os.Getenv(s.env), "$"+s.env
+		if v == "" {
+			v, source = s.value(c), "the config file"
+		}
+		if v == "" {
+			continue
+		}
+		if err := flags.Set(s.flag, v); err != nil {
+			return fmt.Errorf("invalid value %q for -%s from %s: %w", v, s.flag, source, err)
+		}
+	}
+	return nil
+}
+
+// expandHome replaces a leading ~ with the home directory, as a shell
+// would for a path on the command line
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
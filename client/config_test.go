@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+const testConfig = `
+relay = "wss://relay.example.com/ws"
+chunk_size = 8192
+overwrite = "never"
+
+[profiles.work]
+relay = "wss://adit.internal.example.com/ws"
+output_dir = "/srv/incoming"
+
+[[profiles.work.ice_servers]]
+urls = ["turn:turn.internal.example.com:3478"]
+username = "adit"
+credential = "secret"
+
+[profiles.home]
+overwrite = "rename"
+`
+
+func TestLoadConfigProfiles(t *testing.T) {
+	path := writeConfigFile(t, testConfig)
+
+	c, err := loadConfig(path, true, "")
+	require.NoError(t, err)
+	assert.Equal(t, clientConfig{Relay: "wss://relay.example.com/ws", ChunkSize: 8192, Overwrite: "never"}, c)
+
+	c, err = loadConfig(path, true, "work")
+	require.NoError(t, err)
+	assert.Equal(t, clientConfig{
+		Relay:      "wss://adit.internal.example.com/ws",
+		ICEServers: []iceServer{{URLs: []string{"turn:turn.internal.example.com:3478"}, Username: "adit", Credential: "secret"}},
+		OutputDir:  "/srv/incoming",
+		ChunkSize:  8192,
+		Overwrite:  "never",
+	}, c, "the profile should replace only the defaults it sets")
+
+	_, err = loadConfig(path, true, "office")
+	assert.ErrorContains(t, err, `profile "office" is not in the config file`)
+	assert.ErrorContains(t, err, "it has: home, work")
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+
+	c, err := loadConfig(path, false, "")
+	require.NoError(t, err, "the default config file need not exist")
+	assert.Equal(t, clientConfig{}, c)
+
+	_, err = loadConfig(path, true, "")
+	assert.ErrorContains(t, err, "unable to read config file")
+
+	_, err = loadConfig(path, false, "work")
+	assert.ErrorContains(t, err, `profile "work" is not in the config file`)
+}
+
+func TestLoadConfigRejectsInvalidFiles(t *testing.T) {
+	tests := map[string]struct {
+		contents, err string
+	}{
+		"unknown setting":     {`relay_url = "wss://relay.example.com/ws"`, "unknown setting relay_url"},
+		"invalid toml":        {`relay = `, "unable to read config file"},
+		"ice server no urls":  {"[[ice_servers]]\nusername = \"adit\"", "has no urls"},
+		"turn no credentials": {"[[ice_servers]]\nurls = [\"turns:turn.example.com\"]", "needs a username and credential"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadConfig(writeConfigFile(t, tt.contents), true, "")
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	fs := flag.NewFlagSet("adit", flag.ContinueOnError)
+	relay := fs.String("r", "wss://default.example.com/ws", "")
+	chunkSize := fs.Int("b", 16384, "")
+	output := fs.String("o", "", "")
+	overwrite := fs.String("overwrite", "always", "")
+	stun := fs.String("s", "", "")
+	require.NoError(t, fs.Parse([]string{"-r", "wss://flag.example.com/ws"}))
+
+	t.Setenv("ADIT_RELAY", "wss://env.example.com/ws")
+	t.Setenv("ADIT_CHUNK_SIZE", "4096")
+	t.Setenv("ADIT_OUTPUT_DIR", "")
+	t.Setenv("ADIT_OVERWRITE", "")
+	t.Setenv("ADIT_STUN_SERVER", "")
+	c := clientConfig{Relay: "wss://file.example.com/ws", ChunkSize: 8192, OutputDir: "/srv/incoming"}
+	require.NoError(t, applyConfig(fs, c))
+
+	assert.Equal(t, "wss://flag.example.com/ws", *relay, "flag should override the environment")
+	assert.Equal(t, 4096, *chunkSize, "environment should override the file")
+	assert.Equal(t, "/srv/incoming", *output, "file should override the default")
+	assert.Equal(t, "always", *overwrite, "the default is kept when nothing is set")
+	assert.Empty(t, *stun)
+
+	fs = flag.NewFlagSet("adit", flag.ContinueOnError)
+	fs.Int("b", 16384, "")
+	t.Setenv("ADIT_RELAY", "")
+	t.Setenv("ADIT_CHUNK_SIZE", "lots")
+	assert.ErrorContains(t, applyConfig(fs, clientConfig{}), `invalid value "lots" for -b from $ADIT_CHUNK_SIZE`)
+}
+
+func TestExpandHome(t *testing.T) {
+	t.Setenv("HOME", "/home/adit")
+	assert.Equal(t, "/home/adit/Downloads", expandHome("~/Downloads"))
+	assert.Equal(t, "/home/adit", expandHome("~"))
+	assert.Equal(t, "/srv/~/incoming", expandHome("/srv/~/incoming"))
+}
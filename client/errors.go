@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/Ryan-Har/adit/client/transfer"
+	"github.com/Ryan-Har/adit/protocol"
+)
+
+// relayError describes how an error code from the relay server is reported
+// to the user
+type relayError struct {
+	description string
+	exitCode    int
+}
+
+var relayErrors = map[string]relayError{
+	protocol.CodePhraseNotFound: {
+		description: "no transfer was found for that code, check it was typed correctly and that the sender is still waiting",
+		exitCode:    exitCodeNotFound,
+	},
+	protocol.CodePhraseClaimed: {
+		description: "the file for that code has already been collected by someone else",
+		exitCode:    exitCodeNotFound,
+	},
+	protocol.CodePhraseRejected: {
+		exitCode: exitBadArguments,
+	},
+	protocol.CodePhraseInUse: {
+		description: "the code chosen with -code is already in use, choose another",
+		exitCode:    exitBadArguments,
+	},
+	protocol.CodeMalformedSDP: {
+		description: "the relay server rejected the connection details sent by this client",
+		exitCode:    exitPeerConnectionFailed,
+	},
+	protocol.CodeMalformedCandidate: {
+		description: "the relay server rejected the network candidates sent by this client",
+		exitCode:    exitPeerConnectionFailed,
+	},
+	protocol.CodeLimitExceeded: {
+		description: "the relay server rejected the connection as this client sent too many network candidates",
+		exitCode:    exitPeerConnectionFailed,
+	},
+	protocol.CodeUnknownMessageType: {
+		description: "the relay server did not understand a message sent by this client, check that adit is up to date",
+		exitCode:    exitRelayUnreachable,
+	},
+	protocol.CodeRateLimited: {
+		description: "too many attempts have been made to collect a file",
+		exitCode:    exitRelayUnreachable,
+	},
+	protocol.CodeSessionInvalidated: {
+		description: "too many incorrect attempts were made to collect this file so the code has been cancelled, send the file again for a new code",
+		exitCode:    exitCodeNotFound,
+	},
+	protocol.CodeSessionExpired: {
+		description: "the code expired before the transfer was set up, send the file again for a new code",
+		exitCode:    exitCodeNotFound,
+	},
+	protocol.CodeUnauthorized: {
+		description: "the relay server requires authentication, check the token given with -token or $ADIT_TOKEN",
+		exitCode:    exitRelayUnreachable,
+	},
+	protocol.CodeServerDraining: {
+		description: "the relay server is restarting",
+		exitCode:    exitRelayUnreachable,
+	},
+	protocol.CodeUnsupportedVersion: {
+		description: "this version of adit is not supported by the relay server, please upgrade",
+		exitCode:    exitRelayUnreachable,
+	},
+}
+
+// Exit codes, each error which stops adit maps to one of them. They are
+// documented in the README, so existing codes must not change.
+const (
+	exitOK = 0
+	// exitUnexpected is used for errors which have no code of their own
+	exitUnexpected = 1
+	// exitBadArguments matches the code the flag package exits with
+	exitBadArguments         = 2
+	exitRelayUnreachable     = 3
+	exitCodeNotFound         = 4
+	exitPeerConnectionFailed = 5
+	exitTransferAborted      = 6
+	exitIntegrityFailure     = 7
+	exitDiskError            = 8
+	exitUserRejected         = 9
+	// exitCancelled is used when adit is interrupted, such as by Ctrl-C
+	exitCancelled = 10
+)
+
+// errStalled is the cause of a transfer stopped for making no progress
+var errStalled = errors.New("no data was transferred")
+
+// usageError is a problem with the arguments adit was run with
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string { return e.err.Error() }
+func (e usageError) Unwrap() error { return e.err }
+
+// errorExitCodes maps errors returned by the transfer package, or from
+// watching its progress, to exit codes
+var errorExitCodes = []struct {
+	err      error
+	exitCode int
+}{
+	{transfer.ErrCustomCodeUnsupported, exitBadArguments},
+	{transfer.ErrChecksumMismatch, exitIntegrityFailure},
+	{transfer.ErrMalformedMessage, exitIntegrityFailure},
+	{transfer.ErrTransferAborted, exitTransferAborted},
+	{transfer.ErrIncompleteTransfer, exitTransferAborted},
+	{errStalled, exitTransferAborted},
+	{transfer.ErrPeerConnectionFailed, exitPeerConnectionFailed},
+	{transfer.ErrPeerTimeout, exitPeerConnectionFailed},
+	{transfer.ErrFileExists, exitDiskError},
+	{transfer.ErrSaveFailed, exitDiskError},
+}
+
+// describeError returns the message to show the user and the exit code to
+// use for an error which ended the transfer
+func describeError(err error) (string, int) {
+	if errors.As(err, new(usageError)) {
+		return err.Error(), exitBadArguments
+	}
+	if errors.Is(err, errNoCode) {
+		return err.Error(), exitUserRejected
+	}
+	if errors.Is(err, transfer.ErrPeerDisconnected) {
+		return transfer.ErrPeerDisconnected.Error(), exitTransferAborted
+	}
+	for _, e := range errorExitCodes {
+		if errors.Is(err, e.err) {
+			return err.Error(), e.exitCode
+		}
+	}
+
+	// errors from the relay are checked before losing the connection to
+	// it, as reconnecting may fail with one
+	var relayErr *protocol.Error
+	if errors.As(err, &relayErr) {
+		return describeRelayError(relayErr)
+	}
+	if errors.Is(err, transfer.ErrRelayUnreachable) {
+		return err.Error(), exitRelayUnreachable
+	}
+	if errors.As(err, new(*fs.PathError)) {
+		return err.Error(), exitDiskError
+	}
+	return err.Error(), exitUnexpected
+}
+
+func describeRelayError(relayErr *protocol.Error) (string, int) {
+	re, ok := relayErrors[relayErr.Code]
+	if !ok {
+		re = relayError{exitCode: exitRelayUnreachable}
+	}
+
+	// without a description of its own the relay's message is shown, as it
+	// has the details
+	description := re.description
+	if description == "" {
+		description = relayErr.Message
+	}
+	if relayErr.Retryable {
+		description += ", please try again later"
+	}
+	if relayErr.Suggestion != "" {
+		description += fmt.Sprintf(". did you mean %s?", relayErr.Suggestion)
+	}
+	return description, re.exitCode
+}
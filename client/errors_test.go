@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+
+	"github.com/Ryan-Har/adit/client/transfer"
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeErrorRelayCode(t *testing.T) {
+	err := fmt.Errorf("unable to collect from sender: %w", &protocol.Error{Code: protocol.CodePhraseNotFound})
+
+	description, exitCode := describeError(err)
+	assert.Equal(t, relayErrors[protocol.CodePhraseNotFound].description, description)
+	assert.Equal(t, exitCodeNotFound, exitCode)
+}
+
+func TestDescribeErrorRetryable(t *testing.T) {
+	description, exitCode := describeError(&protocol.Error{Code: protocol.CodeRateLimited, Retryable: true})
+	assert.Equal(t, "too many attempts have been made to collect a file, please try again later", description)
+	assert.Equal(t, exitRelayUnreachable, exitCode)
+}
+
+func TestDescribeErrorUnknown(t *testing.T) {
+	description, exitCode := describeError(&protocol.Error{Code: "something_new", Message: "relay message"})
+	assert.Equal(t, "relay message", description)
+	assert.Equal(t, exitRelayUnreachable, exitCode, "errors from the relay mean it refused the transfer")
+
+	description, exitCode = describeError(errors.New("local failure"))
+	assert.Equal(t, "local failure", description)
+	assert.Equal(t, exitUnexpected, exitCode)
+}
+
+func TestDescribeErrorPeerDisconnected(t *testing.T) {
+	description, exitCode := describeError(fmt.Errorf("no collector connected: %w", transfer.ErrPeerDisconnected))
+	assert.Equal(t, transfer.ErrPeerDisconnected.Error(), description)
+	assert.Equal(t, exitTransferAborted, exitCode)
+}
+
+func TestDescribeErrorUsesRelayMessage(t *testing.T) {
+	description, exitCode := describeError(&protocol.Error{Code: protocol.CodePhraseRejected, Message: "phrase is too easy to guess"})
+	assert.Equal(t, "phrase is too easy to guess", description)
+	assert.Equal(t, exitBadArguments, exitCode)
+}
+
+func TestDescribeErrorSuggestion(t *testing.T) {
+	description, exitCode := describeError(&protocol.Error{Code: protocol.CodePhraseNotFound, Suggestion: "7-chosen-murmuring"})
+	assert.Equal(t, relayErrors[protocol.CodePhraseNotFound].description+". did you mean 7-chosen-murmuring?", description)
+	assert.Equal(t, exitCodeNotFound, exitCode)
+}
+
+func TestExitCodes(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		exitCode int
+	}{
+		"bad arguments":          {usageError{errors.New("-code and -words cannot be used together")}, exitBadArguments},
+		"code not supported":     {fmt.Errorf("unable to send offer: %w", transfer.ErrCustomCodeUnsupported), exitBadArguments},
+		"relay unreachable":      {fmt.Errorf("%w at ws://localhost: refused", transfer.ErrRelayUnreachable), exitRelayUnreachable},
+		"relay draining":         {&protocol.Error{Code: protocol.CodeServerDraining}, exitRelayUnreachable},
+		"code not found":         {&protocol.Error{Code: protocol.CodeSessionExpired}, exitCodeNotFound},
+		"connection failed":      {transfer.ErrPeerConnectionFailed, exitPeerConnectionFailed},
+		"no peer":                {fmt.Errorf("no collector connected: %w", transfer.ErrPeerTimeout), exitPeerConnectionFailed},
+		"aborted":                {fmt.Errorf("%w: the collector closed the connection", transfer.ErrTransferAborted), exitTransferAborted},
+		"incomplete":             {transfer.ErrIncompleteTransfer, exitTransferAborted},
+		"checksum":               {transfer.ErrChecksumMismatch, exitIntegrityFailure},
+		"malformed":              {transfer.ErrMalformedMessage, exitIntegrityFailure},
+		"disk":                   {fmt.Errorf("error writing chunk 3: %w", &fs.PathError{Op: "write", Path: "out.bin", Err: errors.New("no space left on device")}), exitDiskError},
+		"file exists":            {fmt.Errorf("%w: out/in.bin", transfer.ErrFileExists), exitDiskError},
+		"collector save failed":  {fmt.Errorf("the collector reported: %w", transfer.ErrSaveFailed), exitDiskError},
+		"collector checksum":     {fmt.Errorf("the collector reported: %w", transfer.ErrChecksumMismatch), exitIntegrityFailure},
+		"no code entered":        {errNoCode, exitUserRejected},
+		"relay error on resume":  {fmt.Errorf("%w, lost connection: %w", transfer.ErrRelayUnreachable, &protocol.Error{Code: protocol.CodeSessionExpired}), exitCodeNotFound},
+		"peer disconnected":      {fmt.Errorf("no collector connected: %w", transfer.ErrPeerDisconnected), exitTransferAborted},
+		"unexpected local error": {errors.New("local failure"), exitUnexpected},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, exitCode := describeError(test.err)
+			assert.Equal(t, test.exitCode, exitCode)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,38 +9,103 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	//"strings"
+	"time"
+
+	"github.com/Ryan-Har/adit/client/transfer"
+	"github.com/Ryan-Har/adit/protocol"
 )
 
 type Flags struct {
 	InputFile            string
 	CollectCode          string
+	ChosenCode           string
+	CodeWords            int
 	Server               *url.URL
 	logLevel             slog.Level
 	ChunkSize            int
 	OutputPath           string
 	OutputFileName       string
 	AdditionalStunServer string
+	// ICEServers replace the default STUN servers when set in the config
+	// file, AdditionalStunServer is included in them
+	ICEServers   []transfer.ICEServer
+	Overwrite    transfer.OverwritePolicy
+	PeerTimeout  time.Duration
+	StallTimeout time.Duration
+	RelayAuth    transfer.RelayAuth
+	// JSON writes events as JSON lines to stdout instead of text
+	JSON bool
 }
 
+// GetFlags parses the command line, the flags are returned with any error
+// found in them so it can be reported as they ask
 func GetFlags() (*Flags, error) {
 	flags := &Flags{}
-	flag.StringVar(&flags.InputFile, "i", "", "Path to the file or folder to be sent")
+	flag.StringVar(&flags.InputFile, "i", "", "Path to the file to be sent")
 	flag.StringVar(&flags.CollectCode, "c", "", "Code provided to collect a file")
-	flag.IntVar(&flags.ChunkSize, "b", 16384, "Size of the chunks the file will be split into for sending in bytes")
-	flag.StringVar(&flags.OutputPath, "o", "", "Output path of the received file")
+	flag.StringVar(&flags.ChosenCode, "code", "", "Code to send the file with instead of a generated one, it must be hard to guess")
+	flag.IntVar(&flags.CodeWords, "words", 0, "Number of words in the generated code, the relay server chooses when 0")
+	flag.IntVar(&flags.ChunkSize, "b", transfer.DefaultChunkSize, "Size of the chunks the file will be split into for sending in bytes, defaults to $ADIT_CHUNK_SIZE or chunk_size in the config file")
+	flag.StringVar(&flags.OutputPath, "o", "", "Output path of the received file, defaults to $ADIT_OUTPUT_DIR or output_dir in the config file")
 	flag.StringVar(&flags.OutputFileName, "f", "", "Output file name")
-	flag.StringVar(&flags.AdditionalStunServer, "s", "", "Stun server")
-	server := flag.String("r", "wss://adit.rharris.dev/ws", "server used to relay messages")
+	flags.Overwrite = transfer.OverwriteAlways
+	flag.Func("overwrite", "What to do when the received file already exists, one of always, never or rename, defaults to $ADIT_OVERWRITE, overwrite in the config file or always", func(v string) error {
+		p, err := transfer.ParseOverwritePolicy(v)
+		if err != nil {
+			return err
+		}
+		flags.Overwrite = p
+		return nil
+	})
+	flag.StringVar(&flags.AdditionalStunServer, "s", "", "Stun server used as well as the default ones or those in the config file, defaults to $ADIT_STUN_SERVER")
+	flag.DurationVar(&flags.PeerTimeout, "t", transfer.DefaultPeerTimeout, "How long to wait for the other peer before giving up")
+	flag.DurationVar(&flags.StallTimeout, "stall-timeout", defaultStallTimeout, "How long the transfer may go without progress before giving up, 0 waits forever")
+	server := flag.String("r", transfer.DefaultRelay.String(), "server used to relay messages, defaults to $ADIT_RELAY or relay in the config file")
+	flag.StringVar(&flags.RelayAuth.Token, "token", os.Getenv("ADIT_TOKEN"), "Token used to authenticate with the relay server, defaults to $ADIT_TOKEN")
+	clientCert := flag.String("tls-cert", "", "Client certificate presented to the relay server")
+	clientKey := flag.String("tls-key", "", "Private key for the client certificate")
 	verbose := flag.Bool("vvv", false, "Enable verbose mode")
+	flag.BoolVar(&flags.JSON, "json", false, "Write events as JSON lines to stdout for scripts, logs go to stderr")
+	configPath := flag.String("config", os.Getenv("ADIT_CONFIG"), "Path to the TOML config file, defaults to $ADIT_CONFIG or "+defaultConfigPath())
+	profile := flag.String("profile", os.Getenv("ADIT_PROFILE"), "Profile from the config file to use, defaults to $ADIT_PROFILE")
 	flag.Parse()
 
-	s, err := url.Parse(*server)
+	// a config file which was asked for must exist, the default one need not
+	required := *configPath != ""
+	if !required {
+		*configPath = defaultConfigPath()
+	}
+	config, err := loadConfig(*configPath, required, *profile)
 	if err != nil {
-		return nil, fmt.Errorf("invalid server url: %w", err)
+		return flags, usageError{err}
+	}
+	if err := applyConfig(flag.CommandLine, config); err != nil {
+		return flags, usageError{err}
+	}
+	if servers := config.iceServers(); len(servers) > 0 {
+		flags.ICEServers = servers
+		if flags.AdditionalStunServer != "" {
+			flags.ICEServers = append(flags.ICEServers, transfer.ICEServer{URLs: []string{flags.AdditionalStunServer}})
+		}
+	}
+
+	// the relay may be given as adit.example.com rather than its full url
+	s, err := transfer.ParseRelayURL(*server)
+	if err != nil {
+		return flags, usageError{err}
+	}
+	flags.Server = &s
+
+	if (*clientCert == "") != (*clientKey == "") {
+		return flags, usageError{errors.New("the client certificate and key must be provided together")}
+	}
+	if *clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		if err != nil {
+			return flags, usageError{fmt.Errorf("unable to load client certificate: %w", err)}
+		}
+		flags.RelayAuth.Certificates = []tls.Certificate{cert}
 	}
-	//TODO: handle difference cases of the server input, automatically adding the scheme for example
-	flags.Server = s
 
 	if *verbose {
 		flags.logLevel = slog.LevelInfo
@@ -47,19 +113,45 @@ func GetFlags() (*Flags, error) {
 		flags.logLevel = slog.LevelError
 	}
 
+	if flags.InputFile == "" && flags.CollectCode == "" && !flags.JSON && canPromptForCode() {
+		code, err := promptForCode()
+		if err != nil {
+			return flags, err
+		}
+		flags.CollectCode = code
+	}
 	if flags.InputFile == "" && flags.CollectCode == "" {
-		return nil, errors.New("adit requires a file to send or a code to collect, --help for more information")
+		return flags, usageError{errors.New("adit requires a file to send or a code to collect, --help for more information")}
 	}
 	if flags.InputFile != "" && flags.CollectCode != "" {
-		return nil, errors.New("unable to collect and accept input at the same time. ensure that only the -i or -c flag is entered")
+		return flags, usageError{errors.New("unable to collect and accept input at the same time. ensure that only the -i or -c flag is entered")}
 	}
 
+	if (flags.ChosenCode != "" || flags.CodeWords != 0) && flags.InputFile == "" {
+		return flags, usageError{errors.New("-code and -words can only be used when sending a file")}
+	}
+	if flags.ChosenCode != "" && flags.CodeWords != 0 {
+		return flags, usageError{errors.New("-code and -words cannot be used together")}
+	}
+	if flags.CodeWords < 0 {
+		return flags, usageError{errors.New("the number of words in the code cannot be negative")}
+	}
+	// codes are not case sensitive and may be typed with spaces
+	flags.CollectCode = protocol.NormalisePhrase(flags.CollectCode)
+
 	cleanOutPath, err := ensureDirExists(flags.OutputPath)
 	if err != nil {
-		return nil, err
+		return flags, err
 	}
 	flags.OutputPath = cleanOutPath
 
+	if flags.PeerTimeout <= 0 {
+		return flags, usageError{errors.New("the peer timeout must be greater than zero")}
+	}
+	if flags.StallTimeout < 0 {
+		return flags, usageError{errors.New("the stall timeout cannot be negative")}
+	}
+
 	return flags, nil
 }
 
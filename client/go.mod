@@ -3,9 +3,12 @@ module github.com/Ryan-Har/adit/client
 go 1.22.3
 
 require (
+	github.com/BurntSushi/toml v1.4.0
+	github.com/Ryan-Har/adit/protocol v0.0.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/pion/webrtc/v3 v3.3.4
 	github.com/stretchr/testify v1.9.0
+	golang.org/x/term v0.25.0
 )
 
 require (
@@ -33,3 +36,5 @@ require (
 	golang.org/x/sys v0.26.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/Ryan-Har/adit/protocol => ../protocol
@@ -1,126 +1,146 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
 
-	"github.com/pion/webrtc/v3"
+	"github.com/Ryan-Har/adit/client/transfer"
 )
 
-type action string
-
-const (
-	Sender    action = "sender"
-	Collector action = "collector"
-)
-
-func init() {
-	SerialisedChunks = make(map[int]FilePacket)
-}
-
 func main() {
 	flags, err := GetFlags()
+	out := newReporter(os.Stdout, flags != nil && flags.JSON)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		description, exitCode := describeError(err)
+		out.failed(description, exitCode)
+		os.Exit(exitCode)
 	}
 
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: flags.logLevel})))
-
-	var endWG sync.WaitGroup
-	endWG.Add(1)
-	establishConnection(flags, &endWG)
-	endWG.Wait()
-	os.Exit(0)
-}
-
-func establishConnection(flags *Flags, endWG *sync.WaitGroup) {
-	var runType action
-
-	if flags.InputFile != "" {
-		runType = Sender
-	}
-	if flags.CollectCode != "" {
-		runType = Collector
+	// with -json stdout only has events on it
+	logOutput := os.Stdout
+	if flags.JSON {
+		logOutput = os.Stderr
 	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: flags.logLevel})))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if runType == Sender {
-		if _, err := readFileInChunks(flags.InputFile, flags.ChunkSize); err != nil {
-			slog.Error("unable to read provided file", "error", err.Error())
-			os.Exit(1)
+	if err := run(ctx, flags, out); err != nil {
+		if ctx.Err() != nil {
+			out.cancelled()
+			os.Exit(exitCancelled)
 		}
+		description, exitCode := describeError(err)
+		out.failed(description, exitCode)
+		os.Exit(exitCode)
 	}
+	os.Exit(exitOK)
+}
 
-	ws, err := WebsocketConnect(*flags.Server)
-	if err != nil {
-		slog.Error("unable to initialise websocket connection", "error", err.Error())
-		os.Exit(2)
+// run sends or collects a file as set by the flags, reporting its progress
+// to out
+func run(ctx context.Context, flags *Flags, out reporter) error {
+	var prog progress
+	var display sync.WaitGroup
+	defer display.Wait()
+	// stops the progress display if the transfer fails, and the transfer if
+	// it stalls
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// the metadata is set from the transfer's goroutines
+	var file atomic.Pointer[transfer.FileMetadata]
+	startDisplay := func(m transfer.FileMetadata) {
+		file.Store(&m)
+		prog.startFile(m.FileName, m.FileSize)
+		display.Add(1)
+		go func() {
+			defer display.Done()
+			watchProgress(ctx, &prog, out.progressInterval(), flags.StallTimeout, out.progress, func() {
+				cancel(fmt.Errorf("%w for %s", errStalled, flags.StallTimeout))
+			})
+		}()
 	}
-	go ws.keepAlive()
 
-	rtc, err := CreatePeerConnection(flags.AdditionalStunServer)
-	if err != nil {
-		slog.Error("unable to create peer connection", "error", err.Error())
-		os.Exit(3)
+	opts := transfer.Options{
+		Relay:       *flags.Server,
+		Auth:        flags.RelayAuth,
+		ChunkSize:   flags.ChunkSize,
+		PeerTimeout: flags.PeerTimeout,
+		Code:        flags.ChosenCode,
+		Words:       flags.CodeWords,
+		OnCode:      out.code,
+		OnProgress: func(p transfer.Progress) {
+			prog.bytes.Store(p.Bytes)
+		},
+		OnVerified: func(v transfer.Verification) {
+			// every chunk has arrived, so the display is about to finish
+			display.Wait()
+			out.verified(v)
+		},
 	}
-
-	rtcDataChan, err := rtc.CreateDataChannel(runType, flags, endWG)
-	if err != nil {
-		slog.Error("unable to create data channel", "error", err.Error())
-		return
+	if len(flags.ICEServers) > 0 {
+		opts.ICEServers = flags.ICEServers
+	} else if flags.AdditionalStunServer != "" {
+		opts.STUNServers = append(slices.Clone(transfer.DefaultSTUNServers), flags.AdditionalStunServer)
 	}
 
-	go ws.HandleIncomingMessages(rtc)
-
-	rtc.HandleChanges(ws, endWG)
-
-	switch runType {
-	case Sender:
-		rtc.HandleRetransmission(rtcDataChan, flags)
-		offerSDP, err := rtc.CreateOffer()
+	if flags.InputFile != "" {
+		src, err := transfer.OpenFile(flags.InputFile)
 		if err != nil {
-			slog.Error("unable to create offer", "error", err.Error())
+			return usageError{fmt.Errorf("unable to read provided file: %w", err)}
 		}
+		defer src.Close()
 
-		if err := ws.SendWebrtcSessionDescription(offerSDP); err != nil {
-			slog.Error("unable to send offer", "error", err.Error())
+		opts.OnConnected = func() {
+			out.connected("collector")
 		}
-
-		for {
-			if ws.answerSDP.SDP != "" {
-				break
-			}
-		}
-
-	case Collector:
-		ws.Phrase = flags.CollectCode
-		rtc.HandleFileReception(rtcDataChan, flags, endWG)
-		if err := ws.GetOffer(); err != nil {
-			slog.Error("unable to get offer from sender", "error", err.Error())
-		}
-
-		for {
-			if ws.offerSDP.SDP != "" {
-				break
-			}
-		}
-
-		answerSDP, err := rtc.CreateAnswer()
-		if err != nil {
-			slog.Error("unable to create answer", "error", err.Error())
-		}
-
-		if err := ws.SendWebrtcSessionDescription(answerSDP); err != nil {
-			slog.Error("unable to send answer", "error", err.Error())
+		opts.OnFile = startDisplay
+		if err := transfer.Send(ctx, src, opts); err != nil {
+			return stallCause(ctx, err)
 		}
+		display.Wait()
+		out.done(true, flags.InputFile, *file.Load())
+		return nil
 	}
 
-	rtc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate != nil {
-			ws.SendIceCandidate(candidate)
+	opts.OnConnected = func() {
+		out.connected("sender")
+	}
+	sink := transfer.DirSink{Dir: flags.OutputPath, Name: flags.OutputFileName, Overwrite: flags.Overwrite}
+	// the path is found before the file is saved, as once it has been a
+	// renamed file would be given the next free name
+	var path atomic.Pointer[string]
+	opts.OnFile = func(m transfer.FileMetadata) {
+		// an invalid name fails the transfer when the file is created
+		if p, err := sink.Path(m); err == nil {
+			path.Store(&p)
 		}
-	})
+		out.receiving(m)
+		startDisplay(m)
+	}
+	if err := transfer.Receive(ctx, flags.CollectCode, sink, opts); err != nil {
+		return stallCause(ctx, err)
+	}
+	display.Wait()
+	out.done(false, *path.Load(), *file.Load())
+	return nil
+}
 
+// stallCause returns why the transfer was stopped if it stalled, otherwise
+// err
+func stallCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errStalled) {
+		return cause
+	}
+	return err
 }
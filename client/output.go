@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Ryan-Har/adit/client/transfer"
+)
+
+// reporter tells the user how the transfer is going, as text for people or
+// as JSON lines for scripts with -json
+type reporter interface {
+	code(code string)
+	// connected is called with the role of the peer once connected to it
+	connected(peer string)
+	receiving(m transfer.FileMetadata)
+	// progressInterval is how often progress is called
+	progressInterval() time.Duration
+	// progress shows a sample of the transfer, the last of each file is done
+	progress(s sample)
+	verified(v transfer.Verification)
+	// done is called once the file at path has been sent or received
+	done(sent bool, path string, m transfer.FileMetadata)
+	// failed is called with the description of the error which stopped
+	// adit and the code it exits with
+	failed(description string, exitCode int)
+	cancelled()
+}
+
+func newReporter(w io.Writer, jsonOutput bool) reporter {
+	if jsonOutput {
+		return &jsonReporter{enc: json.NewEncoder(w)}
+	}
+	return textReporter{w: w, terminal: isTerminal(w)}
+}
+
+// textReporter redraws a progress bar on terminals, other output is given a
+// line of progress every plainProgressInterval instead
+type textReporter struct {
+	w        io.Writer
+	terminal bool
+}
+
+const (
+	terminalProgressInterval = 100 * time.Millisecond
+	plainProgressInterval    = 5 * time.Second
+)
+
+func (r textReporter) code(code string) {
+	//notify user so it can be sent to sender
+	fmt.Fprintln(r.w, "Phrase generated for file transfer:", code)
+}
+
+func (r textReporter) connected(peer string) {
+	fmt.Fprintf(r.w, "Connection to %s established\n", peer)
+}
+
+func (r textReporter) receiving(m transfer.FileMetadata) {
+	fmt.Fprintf(r.w, "receiving file: %s, size: %d bytes\n", m.FileName, m.FileSize)
+}
+
+func (r textReporter) progressInterval() time.Duration {
+	if r.terminal {
+		return terminalProgressInterval
+	}
+	return plainProgressInterval
+}
+
+func (r textReporter) progress(s sample) {
+	if !r.terminal {
+		fmt.Fprintln(r.w, progressLine(s))
+	} else {
+		// clears the rest of a longer line drawn before
+		fmt.Fprintf(r.w, "\r%s\x1b[K", progressBar(s))
+		if s.done {
+			fmt.Fprintln(r.w)
+		}
+	}
+	if s.done {
+		fmt.Fprintln(r.w, "Waiting for file to be saved")
+	}
+}
+
+func (r textReporter) verified(v transfer.Verification) {
+	switch {
+	case !v.Checked():
+		fmt.Fprintln(r.w, "The sender did not send a checksum, the file could not be verified")
+	case v.OK():
+		fmt.Fprintln(r.w, "File verified, sha256:", v.SHA256)
+	}
+}
+
+func (r textReporter) done(sent bool, path string, m transfer.FileMetadata) {
+	if sent {
+		fmt.Fprintln(r.w, "File recipient saved file, connection closed")
+		return
+	}
+	fmt.Fprintln(r.w, "File successfully received and written!")
+}
+
+func (r textReporter) failed(description string, exitCode int) {
+	fmt.Fprintln(r.w, description)
+}
+
+func (r textReporter) cancelled() {
+	fmt.Fprintln(r.w, "\nTransfer cancelled")
+}
+
+// jsonProgressInterval is how often progress events are written
+const jsonProgressInterval = 500 * time.Millisecond
+
+// jsonReporter writes a JSON object per line for each event, they all have
+// the name of the event and the time it happened
+type jsonReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+type eventHeader struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+func header(event string) eventHeader {
+	return eventHeader{Event: event, Time: time.Now().UTC()}
+}
+
+func (r *jsonReporter) emit(event any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// stdout is the only place to report a failure to write to it
+	_ = r.enc.Encode(event)
+}
+
+func (r *jsonReporter) code(code string) {
+	r.emit(struct {
+		eventHeader
+		Code string `json:"code"`
+	}{header("code"), code})
+}
+
+func (r *jsonReporter) connected(peer string) {
+	r.emit(struct {
+		eventHeader
+		Peer string `json:"peer"`
+	}{header("connected"), peer})
+}
+
+func (r *jsonReporter) receiving(m transfer.FileMetadata) {
+	r.emit(struct {
+		eventHeader
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		SHA256 string `json:"sha256,omitempty"`
+	}{header("file"), m.FileName, m.FileSize, m.SHA256})
+}
+
+func (r *jsonReporter) progressInterval() time.Duration {
+	return jsonProgressInterval
+}
+
+// progress writes the bytes transferred with the average and current rates
+// in bytes per second and the seconds left, which is null until known
+func (r *jsonReporter) progress(s sample) {
+	var eta *float64
+	if s.etaKnown {
+		left := s.eta.Seconds()
+		eta = &left
+	}
+	r.emit(struct {
+		eventHeader
+		File        string   `json:"file"`
+		Bytes       int64    `json:"bytes"`
+		Total       int64    `json:"total"`
+		Rate        float64  `json:"rate"`
+		CurrentRate float64  `json:"currentRate"`
+		ETA         *float64 `json:"eta"`
+	}{header("progress"), s.file.name, s.bytes, s.file.size, s.avg, s.current, eta})
+}
+
+func (r *jsonReporter) verified(v transfer.Verification) {
+	r.emit(struct {
+		eventHeader
+		OK       bool   `json:"ok"`
+		Checked  bool   `json:"checked"`
+		Expected string `json:"expected,omitempty"`
+		SHA256   string `json:"sha256"`
+	}{header("verified"), v.OK(), v.Checked(), v.Expected, v.SHA256})
+}
+
+func (r *jsonReporter) done(sent bool, path string, m transfer.FileMetadata) {
+	direction := "received"
+	if sent {
+		direction = "sent"
+	}
+	r.emit(struct {
+		eventHeader
+		Direction string `json:"direction"`
+		Path      string `json:"path"`
+		Size      int64  `json:"size"`
+		SHA256    string `json:"sha256,omitempty"`
+	}{header("complete"), direction, path, m.FileSize, m.SHA256})
+}
+
+func (r *jsonReporter) failed(description string, exitCode int) {
+	r.emit(struct {
+		eventHeader
+		Message  string `json:"message"`
+		ExitCode int    `json:"exitCode"`
+	}{header("error"), description, exitCode})
+}
+
+func (r *jsonReporter) cancelled() {
+	r.failed("transfer cancelled", exitCancelled)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/adit/client/transfer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// events decodes each line written by a jsonReporter
+func events(t *testing.T, out *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var decoded []map[string]any
+	lines := bufio.NewScanner(out)
+	for lines.Scan() {
+		var e map[string]any
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &e), lines.Text())
+		assert.NotEmpty(t, e["time"])
+		delete(e, "time")
+		decoded = append(decoded, e)
+	}
+	return decoded
+}
+
+func TestJSONReporter(t *testing.T) {
+	var out bytes.Buffer
+	r := newReporter(&out, true)
+	m := transfer.FileMetadata{FileName: "digits.txt", FileSize: 10, SHA256: "abc"}
+
+	r.code("7-chosen-murmuring")
+	r.connected("sender")
+	r.receiving(m)
+	r.progress(sample{file: progressFile{name: "digits.txt", size: 10}, bytes: 10, avg: 5, current: 4, etaKnown: true, done: true})
+	r.verified(transfer.Verification{Expected: "abc", SHA256: "abc"})
+	r.done(false, "/tmp/digits.txt", m)
+	r.failed("the file did not arrive complete", exitTransferAborted)
+
+	got := events(t, &out)
+	require.Len(t, got, 7)
+	assert.Equal(t, map[string]any{"event": "code", "code": "7-chosen-murmuring"}, got[0])
+	assert.Equal(t, map[string]any{"event": "connected", "peer": "sender"}, got[1])
+	assert.Equal(t, map[string]any{"event": "file", "name": "digits.txt", "size": 10.0, "sha256": "abc"}, got[2])
+	assert.Equal(t, map[string]any{
+		"event": "progress", "file": "digits.txt",
+		"bytes": 10.0, "total": 10.0, "rate": 5.0, "currentRate": 4.0, "eta": 0.0,
+	}, got[3])
+	assert.Equal(t, map[string]any{"event": "verified", "ok": true, "checked": true, "expected": "abc", "sha256": "abc"}, got[4])
+	assert.Equal(t, map[string]any{"event": "complete", "direction": "received", "path": "/tmp/digits.txt", "size": 10.0, "sha256": "abc"}, got[5])
+	assert.Equal(t, map[string]any{"event": "error", "message": "the file did not arrive complete", "exitCode": 6.0}, got[6])
+}
+
+func TestJSONProgressWithoutRate(t *testing.T) {
+	var out bytes.Buffer
+	newReporter(&out, true).progress(sample{file: progressFile{name: "digits.txt", size: 10}})
+
+	got := events(t, &out)
+	require.Len(t, got, 1)
+	assert.Equal(t, 0.0, got[0]["bytes"])
+	assert.Nil(t, got[0]["eta"], "the time left is unknown before any bytes are transferred")
+}
+
+func TestTextProgressWithoutTerminal(t *testing.T) {
+	var out bytes.Buffer
+	r := newReporter(&out, false)
+	assert.Equal(t, plainProgressInterval, r.progressInterval(), "a buffer is not a terminal")
+
+	r.progress(sample{file: progressFile{name: "digits.txt", size: 2048}, bytes: 1024, current: 512, eta: 2 * time.Second, etaKnown: true})
+	r.progress(sample{file: progressFile{name: "digits.txt", size: 2048}, bytes: 2048, done: true})
+	assert.Equal(t, "digits.txt: 50%, 1.0 KiB of 2.0 KiB, 512 B/s, 00:02 left\n"+
+		"digits.txt: 100%, 2.0 KiB of 2.0 KiB, 0 B/s, --:-- left\n"+
+		"Waiting for file to be saved\n", out.String())
+	assert.NotContains(t, out.String(), "\r", "lines are not redrawn")
+}
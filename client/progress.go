@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	// defaultStallTimeout is how long a transfer may go without progress
+	// before it is abandoned
+	defaultStallTimeout = 30 * time.Second
+	// rateWindow is the period the current rate is measured over
+	rateWindow = 3 * time.Second
+	// barWidth is the number of characters in the progress bar
+	barWidth = 30
+)
+
+// progress counts the bytes transferred of the file, it is updated from the
+// transfer's goroutines and read by the display
+type progress struct {
+	bytes atomic.Int64
+	file  atomic.Pointer[progressFile]
+}
+
+// progressFile is the file being transferred
+type progressFile struct {
+	name string
+	size int64
+}
+
+// startFile resets the count of bytes for the file
+func (p *progress) startFile(name string, size int64) {
+	p.bytes.Store(0)
+	p.file.Store(&progressFile{name: name, size: size})
+}
+
+// sample is the progress of a file at a moment, with the rates in bytes per
+// second it is being transferred at
+type sample struct {
+	file           progressFile
+	bytes          int64
+	current, avg   float64
+	eta            time.Duration
+	etaKnown, done bool
+}
+
+type reading struct {
+	at    time.Time
+	bytes int64
+}
+
+// meter measures the rates of one file from readings of its progress
+type meter struct {
+	first    reading
+	readings []reading
+}
+
+func (m *meter) sample(f progressFile, bytes int64, now time.Time) sample {
+	if m.first.at.IsZero() {
+		m.first = reading{now, bytes}
+	}
+	m.readings = append(m.readings, reading{now, bytes})
+	for len(m.readings) > 2 && now.Sub(m.readings[1].at) >= rateWindow {
+		m.readings = m.readings[1:]
+	}
+
+	s := sample{file: f, bytes: bytes, done: bytes >= f.size}
+	if elapsed := now.Sub(m.first.at).Seconds(); elapsed > 0 {
+		s.avg = float64(bytes-m.first.bytes) / elapsed
+	}
+	if first := m.readings[0]; now.After(first.at) {
+		s.current = float64(bytes-first.bytes) / now.Sub(first.at).Seconds()
+	}
+	// the current rate follows changes in speed, the average covers pauses
+	rate := s.current
+	if rate <= 0 {
+		rate = s.avg
+	}
+	if rate > 0 {
+		s.eta = time.Duration(float64(f.size-bytes) / rate * float64(time.Second))
+		s.etaKnown = true
+	}
+	return s
+}
+
+// watchProgress passes a sample of p to show every interval until the file
+// is complete, the context is done or no bytes are transferred for
+// stallTimeout, when stalled is called. A stallTimeout of zero waits forever.
+func watchProgress(ctx context.Context, p *progress, interval, stallTimeout time.Duration, show func(sample), stalled func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var m meter
+	lastBytes, lastChange := int64(-1), time.Now()
+
+	for {
+		now := time.Now()
+		bytes := p.bytes.Load()
+		if bytes != lastBytes {
+			lastBytes, lastChange = bytes, now
+		}
+
+		s := m.sample(*p.file.Load(), bytes, now)
+		show(s)
+		if s.done {
+			return
+		}
+		if stallTimeout > 0 && now.Sub(lastChange) > stallTimeout {
+			stalled()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isTerminal reports whether w is a terminal which can redraw a line
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// progressBar draws the bar, percentage, amounts and rates on one line
+func progressBar(s sample) string {
+	fraction := 1.0
+	if s.file.size > 0 {
+		fraction = float64(s.bytes) / float64(s.file.size)
+	}
+	filled := int(fraction * barWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %3.0f%% %s/%s %s/s (avg %s/s) ETA %s",
+		bar, fraction*100, formatBytes(s.bytes), formatBytes(s.file.size),
+		formatBytes(int64(s.current)), formatBytes(int64(s.avg)), formatETA(s))
+}
+
+// progressLine describes the progress for output which is not a terminal
+func progressLine(s sample) string {
+	percent := 100.0
+	if s.file.size > 0 {
+		percent = float64(s.bytes) / float64(s.file.size) * 100
+	}
+	return fmt.Sprintf("%s: %.0f%%, %s of %s, %s/s, %s left",
+		s.file.name, percent, formatBytes(s.bytes), formatBytes(s.file.size),
+		formatBytes(int64(s.current)), formatETA(s))
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < len("KMGTPE")-1 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[prefix])
+}
+
+func formatETA(s sample) string {
+	if !s.etaKnown {
+		return "--:--"
+	}
+	eta := s.eta.Round(time.Second)
+	h, m, sec := int(eta.Hours()), int(eta.Minutes())%60, int(eta.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("%02d:%02d", m, sec)
+}
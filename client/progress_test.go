@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeterRates(t *testing.T) {
+	f := progressFile{name: "file.bin", size: 10000}
+	start := time.Now()
+	var m meter
+
+	s := m.sample(f, 0, start)
+	assert.False(t, s.etaKnown, "no rate before any time has passed")
+
+	// 1000 bytes a second for two seconds, then 4000 a second, with the
+	// current rate measured over three seconds
+	m.sample(f, 1000, start.Add(time.Second))
+	m.sample(f, 2000, start.Add(2*time.Second))
+	s = m.sample(f, 6000, start.Add(3*time.Second))
+	assert.InDelta(t, 2000, s.avg, 1)
+	assert.InDelta(t, 2000, s.current, 1, "the current rate is measured over the last few seconds")
+	s = m.sample(f, 10000, start.Add(4*time.Second))
+	assert.InDelta(t, 3000, s.current, 1, "older readings leave the window")
+	assert.True(t, s.done)
+	assert.Equal(t, time.Duration(0), s.eta)
+
+	var stalled meter
+	stalled.sample(f, 5000, start)
+	s = stalled.sample(f, 5000, start.Add(10*time.Second))
+	assert.Zero(t, s.current)
+	assert.Zero(t, s.avg, "bytes transferred before the first reading are not counted")
+	assert.False(t, s.etaKnown)
+}
+
+func TestWatchProgressStalls(t *testing.T) {
+	var p progress
+	p.startFile("file.bin", 100)
+	p.bytes.Store(10)
+
+	stalled := make(chan struct{})
+	var samples []sample
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchProgress(context.Background(), &p, time.Millisecond, 20*time.Millisecond,
+			func(s sample) { samples = append(samples, s) },
+			func() { close(stalled) })
+	}()
+
+	select {
+	case <-stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a transfer without progress should stall")
+	}
+	<-done
+	require.NotEmpty(t, samples)
+	assert.Equal(t, int64(10), samples[len(samples)-1].bytes)
+}
+
+func TestWatchProgressFinishesWithFile(t *testing.T) {
+	var p progress
+	p.startFile("file.bin", 10)
+	p.bytes.Store(4)
+
+	var shown []sample
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchProgress(context.Background(), &p, time.Millisecond, 0, func(s sample) { shown = append(shown, s) }, func() {
+			t.Error("a stall timeout of zero waits forever")
+		})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	p.bytes.Store(10)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watching should finish with the file")
+	}
+
+	require.NotEmpty(t, shown)
+	for _, s := range shown[:len(shown)-1] {
+		assert.False(t, s.done)
+	}
+	assert.True(t, shown[len(shown)-1].done, "the finished file is shown once")
+}
+
+func TestProgressBar(t *testing.T) {
+	s := sample{
+		file:  progressFile{name: "file.bin", size: 4 << 20},
+		bytes: 1 << 20, current: 512 << 10, avg: 256 << 10,
+		eta: 6 * time.Second, etaKnown: true,
+	}
+	assert.Equal(t, "[=======>                      ]  25% 1.0 MiB/4.0 MiB 512.0 KiB/s (avg 256.0 KiB/s) ETA 00:06", progressBar(s))
+
+	s.bytes, s.etaKnown = 4<<20, false
+	assert.Equal(t, "[==============================] 100% 4.0 MiB/4.0 MiB 512.0 KiB/s (avg 256.0 KiB/s) ETA --:--", progressBar(s))
+}
+
+func TestFormatETA(t *testing.T) {
+	assert.Equal(t, "01:05", formatETA(sample{eta: 65 * time.Second, etaKnown: true}))
+	assert.Equal(t, "2:00:01", formatETA(sample{eta: 2*time.Hour + time.Second, etaKnown: true}))
+}
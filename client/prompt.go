@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"golang.org/x/term"
+)
+
+// maxListedCompletions bounds the words listed when tab has several matches
+const maxListedCompletions = 20
+
+var errNoCode = errors.New("no code was entered")
+
+// canPromptForCode reports whether the code can be asked for on the terminal
+func canPromptForCode() bool {
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// promptForCode asks the collector for the code, completing each word from
+// the wordlist when tab is pressed
+func promptForCode() (string, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the code from the terminal: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "Enter the code from the sender, tab completes words: ")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		newLine, newPos, matches := completeCode(line, pos)
+		if newLine != line {
+			return newLine, newPos, true
+		}
+		if len(matches) > 1 {
+			listed := matches[:min(len(matches), maxListedCompletions)]
+			fmt.Fprintf(t, "%s\n", strings.Join(listed, " "))
+		}
+		return "", 0, false
+	}
+
+	code, err := t.ReadLine()
+	if errors.Is(err, io.EOF) {
+		return "", errNoCode
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(code) == "" {
+		return "", errNoCode
+	}
+	return code, nil
+}
+
+// completeCode completes the word before pos in line from the wordlist. A
+// word with a single match is finished and followed by a separator, with
+// several matches it is extended as far as they agree and the matches are
+// returned. The nameplate is not completed.
+func completeCode(line string, pos int) (string, int, []string) {
+	start := strings.LastIndexFunc(line[:pos], func(r rune) bool {
+		return protocol.IsPhraseSeparator(r) || r == ' '
+	}) + 1
+	prefix := strings.ToLower(line[start:pos])
+	if prefix == "" || start == 0 && isNumber(prefix) {
+		return line, pos, nil
+	}
+
+	matches := protocol.WordsWithPrefix(prefix)
+	var completed string
+	switch len(matches) {
+	case 0:
+		return line, pos, nil
+	case 1:
+		completed = matches[0]
+		if !strings.HasPrefix(line[pos:], protocol.PhraseSeparator) {
+			completed += protocol.PhraseSeparator
+		}
+	default:
+		completed = commonPrefix(matches)
+	}
+	return line[:start] + completed + line[pos:], start + len(completed), matches
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+func isNumber(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' }) == -1
+}
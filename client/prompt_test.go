@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompleteCode(t *testing.T) {
+	tests := []struct {
+		line, wantLine string
+		pos, wantPos   int
+		matches        bool
+	}{
+		{line: "7-murmur", pos: 8, wantLine: "7-murmuring-", wantPos: 12},
+		{line: "7-Murmur", pos: 8, wantLine: "7-murmuring-", wantPos: 12},
+		{line: "7 murmur", pos: 8, wantLine: "7 murmuring-", wantPos: 12},
+		{line: "7-murmur-chosen", pos: 8, wantLine: "7-murmuring-chosen", wantPos: 11},
+		{line: "7-choo", pos: 6, wantLine: "7-choos", wantPos: 7, matches: true},
+		{line: "7-cho", pos: 5, wantLine: "7-cho", wantPos: 5, matches: true},
+		{line: "7-", pos: 2, wantLine: "7-", wantPos: 2},
+		{line: "7", pos: 1, wantLine: "7", wantPos: 1},
+		{line: "7-zzz", pos: 5, wantLine: "7-zzz", wantPos: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			line, pos, matches := completeCode(tt.line, tt.pos)
+			assert.Equal(t, tt.wantLine, line)
+			assert.Equal(t, tt.wantPos, pos)
+			assert.Equal(t, tt.matches, len(matches) > 1)
+		})
+	}
+}
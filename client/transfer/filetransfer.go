@@ -0,0 +1,488 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type FileMetadata struct {
+	FileName  string `json:"fileName"`
+	FileSize  int64  `json:"fileSize"`
+	NumChunks int    `json:"numChunks"`
+	// SHA256 is the hex encoded hash of the file, older senders leave it
+	// empty
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Verification is the result of checking a received file against the hash
+// sent with its metadata
+type Verification struct {
+	// Expected is the hash sent by the sender, empty when it sent none
+	Expected string
+	// SHA256 is the hex encoded hash of the file received
+	SHA256 string
+}
+
+// Checked reports whether the sender sent a hash to check the file against
+func (v Verification) Checked() bool {
+	return v.Expected != ""
+}
+
+// OK reports whether the file matches the hash sent by the sender, or
+// whether there was none to check
+func (v Verification) OK() bool {
+	return !v.Checked() || strings.EqualFold(v.Expected, v.SHA256)
+}
+
+type FilePacket struct {
+	SequenceNumber int    `json:"seq"`
+	Data           []byte `json:"data"`
+}
+
+type MissingPacketRequest struct {
+	MissingSequences []int `json:"missingSequences"`
+}
+
+// doneMessage is sent by the sender after the last chunk, and again after
+// each retransmission
+const doneMessage = "done"
+
+// collectorResult is sent by the collector as a text message once it is
+// finished with the file, so the sender can report whether it was saved
+type collectorResult struct {
+	// Error is why the transfer failed, empty once the file is saved
+	Error string `json:"error,omitempty"`
+	// Reason is the entry of resultReasons for Error
+	Reason string `json:"reason,omitempty"`
+}
+
+// resultReasons are the failures the collector tells the sender apart,
+// others abort the transfer
+var resultReasons = []struct {
+	reason string
+	err    error
+}{
+	{"checksum_mismatch", ErrChecksumMismatch},
+	{"malformed_message", ErrMalformedMessage},
+	{"incomplete", ErrIncompleteTransfer},
+	{"save_failed", ErrSaveFailed},
+}
+
+func newCollectorResult(err error) collectorResult {
+	if err == nil {
+		return collectorResult{}
+	}
+	for _, r := range resultReasons {
+		if errors.Is(err, r.err) {
+			return collectorResult{Error: err.Error(), Reason: r.reason}
+		}
+	}
+	return collectorResult{Error: err.Error(), Reason: "aborted"}
+}
+
+// collectorError is a failure reported by the collector, it wraps the
+// error for the reason given
+type collectorError struct {
+	message string
+	err     error
+}
+
+func (e collectorError) Error() string { return "the collector reported: " + e.message }
+func (e collectorError) Unwrap() error { return e.err }
+
+// unmarshallCollectorResult returns the error the collector's result
+// reports, nil when it saved the file
+func unmarshallCollectorResult(msgBytes []byte) error {
+	var r collectorResult
+	if err := json.Unmarshal(msgBytes, &r); err != nil {
+		return fmt.Errorf("%w: unable to parse the collector's result: %v", ErrMalformedMessage, err)
+	}
+	if r.Error == "" && r.Reason == "" {
+		return nil
+	}
+	cause := ErrTransferAborted
+	for _, reason := range resultReasons {
+		if reason.reason == r.Reason {
+			cause = reason.err
+		}
+	}
+	return collectorError{message: r.Error, err: cause}
+}
+
+// maxMissingRequests is how many times the collector asks for chunks which
+// have not arrived before giving up on the transfer
+const maxMissingRequests = 10
+
+// dataChannel is the part of a webrtc.DataChannel used to move the file
+type dataChannel interface {
+	Send([]byte) error
+	SendText(string) error
+}
+
+// maxChunks bounds the number of chunks the collector accepts, as they are
+// all held in memory until the file is complete
+const maxChunks = 1 << 22
+
+func unmarshallMetadata(msgBytes []byte) (FileMetadata, error) {
+	var m FileMetadata
+	if err := json.Unmarshal(msgBytes, &m); err != nil {
+		return FileMetadata{}, err
+	}
+	if err := m.validate(); err != nil {
+		return FileMetadata{}, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	return m, nil
+}
+
+// validate checks the size and number of chunks are possible for a file
+func (m FileMetadata) validate() error {
+	switch {
+	case m.FileSize < 0:
+		return fmt.Errorf("negative file size %d", m.FileSize)
+	case m.NumChunks < 0 || m.NumChunks > maxChunks:
+		return fmt.Errorf("number of chunks %d is not between 0 and %d", m.NumChunks, maxChunks)
+	case m.FileSize == 0 && m.NumChunks != 0:
+		return fmt.Errorf("%d chunks for an empty file", m.NumChunks)
+	case m.FileSize > 0 && m.NumChunks == 0:
+		return fmt.Errorf("no chunks for a file of %d bytes", m.FileSize)
+	case int64(m.NumChunks) > m.FileSize:
+		return fmt.Errorf("%d chunks for a file of %d bytes", m.NumChunks, m.FileSize)
+	}
+	return nil
+}
+
+func unmarshallFilePacket(msgBytes []byte) (FilePacket, error) {
+	var f FilePacket
+	if err := json.Unmarshal(msgBytes, &f); err != nil {
+		return FilePacket{}, err
+	}
+	if f.SequenceNumber < 0 {
+		return FilePacket{}, fmt.Errorf("%w: negative sequence number %d", ErrMalformedMessage, f.SequenceNumber)
+	}
+	return f, nil
+}
+
+func unmashallMissingPacketRequest(msgBytes []byte) (MissingPacketRequest, error) {
+	var mp MissingPacketRequest
+	if err := json.Unmarshal(msgBytes, &mp); err != nil {
+		return MissingPacketRequest{}, err
+	}
+	if len(mp.MissingSequences) > maxChunks {
+		return MissingPacketRequest{}, fmt.Errorf("%w: %d missing chunks requested", ErrMalformedMessage, len(mp.MissingSequences))
+	}
+	for _, seq := range mp.MissingSequences {
+		if seq < 0 {
+			return MissingPacketRequest{}, fmt.Errorf("%w: negative sequence number %d", ErrMalformedMessage, seq)
+		}
+	}
+	return mp, nil
+}
+
+// sender sends a Source in chunks, reading them again when the collector
+// asks for any it is missing
+type sender struct {
+	src       Source
+	chunkSize int
+	metadata  FileMetadata
+	log       *slog.Logger
+	progress  func(Progress)
+	// sendMu stops a retransmission interleaving with the first pass
+	sendMu sync.Mutex
+}
+
+func newSender(src Source, chunkSize int, log *slog.Logger, progress func(Progress)) *sender {
+	size := src.Size()
+	return &sender{
+		src:       src,
+		chunkSize: chunkSize,
+		metadata: FileMetadata{
+			FileName:  src.Name(),
+			FileSize:  size,
+			NumChunks: int((size + int64(chunkSize) - 1) / int64(chunkSize)),
+		},
+		log:      log,
+		progress: progress,
+	}
+}
+
+// hash sets the hash of the file in the metadata sent to the collector
+func (s *sender) hash() error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(s.src, 0, s.metadata.FileSize)); err != nil {
+		return fmt.Errorf("error hashing the file: %w", err)
+	}
+	s.metadata.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// readChunk returns the chunk with sequence number seq
+func (s *sender) readChunk(seq int) (FilePacket, error) {
+	if seq < 0 || seq >= s.metadata.NumChunks {
+		return FilePacket{}, fmt.Errorf("chunk %d does not exist", seq)
+	}
+	offset := int64(seq) * int64(s.chunkSize)
+	data := make([]byte, min(int64(s.chunkSize), s.metadata.FileSize-offset))
+	if _, err := s.src.ReadAt(data, offset); err != nil && !errors.Is(err, io.EOF) {
+		return FilePacket{}, fmt.Errorf("error reading chunk %d: %w", seq, err)
+	}
+	return FilePacket{SequenceNumber: seq, Data: data}, nil
+}
+
+func (s *sender) sendChunk(d dataChannel, seq int) (int, error) {
+	packet, err := s.readChunk(seq)
+	if err != nil {
+		return 0, err
+	}
+	packetBytes, err := json.Marshal(packet)
+	if err != nil {
+		return 0, fmt.Errorf("error serializing packet %d: %v", seq, err)
+	}
+	if err := d.Send(packetBytes); err != nil {
+		return 0, fmt.Errorf("error sending packet %d: %v", seq, err)
+	}
+	return len(packet.Data), nil
+}
+
+// handleFileSending sends the metadata, every chunk and then the done message
+func (s *sender) handleFileSending(d dataChannel) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	metadataBytes, err := json.Marshal(s.metadata)
+	if err != nil {
+		return err
+	}
+	if err := d.Send(metadataBytes); err != nil {
+		return fmt.Errorf("error sending file metadata: %w", err)
+	}
+
+	var bytesSent int64
+	for seq := range s.metadata.NumChunks {
+		n, err := s.sendChunk(d, seq)
+		if err != nil {
+			return err
+		}
+		bytesSent += int64(n)
+		if s.progress != nil {
+			s.progress(Progress{Bytes: bytesSent, Total: s.metadata.FileSize})
+		}
+	}
+
+	if err := d.SendText(doneMessage); err != nil {
+		return fmt.Errorf("error sending done message: %w", err)
+	}
+	return nil
+}
+
+// HandleRetransmission resends the chunks the collector reports missing,
+// followed by the done message
+func (s *sender) HandleRetransmission(d dataChannel, msg webrtc.DataChannelMessage) {
+	request, err := unmashallMissingPacketRequest(msg.Data)
+	if err != nil {
+		s.log.Error("Error parsing Missing packet request", "error", err.Error())
+		return
+	}
+	if len(request.MissingSequences) > s.metadata.NumChunks {
+		s.log.Error("ignoring request for more chunks than the file has", "requested", len(request.MissingSequences))
+		return
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	for _, seq := range request.MissingSequences {
+		if _, err := s.sendChunk(d, seq); err != nil {
+			s.log.Error("unable to fulfil retransmission request", "seq", seq, "error", err)
+			return
+		}
+		s.log.Info("retransmission request fulfilled", "seq", seq)
+	}
+	if err = d.SendText(doneMessage); err != nil {
+		s.log.Error("error sending done message", "error", err.Error())
+	}
+}
+
+// receiver collects the chunks of a file and writes them to a Sink once
+// every one has arrived
+type receiver struct {
+	sink       Sink
+	log        *slog.Logger
+	onFile     func(FileMetadata)
+	progress   func(Progress)
+	onVerified func(Verification)
+	// finish is called once with the result of the transfer
+	finish func(error)
+
+	metadata      *FileMetadata
+	chunks        map[int]FilePacket
+	bytesReceived int64
+	// missingRequests counts the requests made for missing chunks
+	missingRequests int
+	// finished is set once the result has been passed to finish
+	finished bool
+}
+
+func newReceiver(sink Sink, log *slog.Logger, finish func(error)) *receiver {
+	return &receiver{
+		sink:   sink,
+		log:    log,
+		finish: finish,
+		chunks: make(map[int]FilePacket),
+	}
+}
+
+// HandleFileReception handles a message from the sender, which is the
+// metadata first, then chunks and the done message once they are all sent.
+// Messages from a data channel are delivered one at a time.
+func (r *receiver) HandleFileReception(d dataChannel, msg webrtc.DataChannelMessage) {
+	switch {
+	case r.finished:
+		return
+	case r.metadata == nil && !msg.IsString:
+		metadata, err := unmarshallMetadata(msg.Data)
+		if err != nil {
+			r.end(d, fmt.Errorf("unable to parse file metadata: %w", err))
+			return
+		}
+		r.metadata = &metadata
+		if r.onFile != nil {
+			r.onFile(metadata)
+		}
+	case msg.IsString && string(msg.Data) == doneMessage:
+		// verify the file and request retransmission of chunks if required
+		if r.metadata == nil {
+			r.end(d, errors.New("sender finished without sending the file metadata"))
+			return
+		}
+		missingSeq, ok := r.checkForMissingChunks()
+		if ok {
+			if r.bytesReceived != r.metadata.FileSize {
+				r.end(d, fmt.Errorf("%w: received %d bytes of a %d byte file",
+					ErrMalformedMessage, r.bytesReceived, r.metadata.FileSize))
+				return
+			}
+			r.end(d, r.writeToSink())
+			return
+		}
+		if r.missingRequests == maxMissingRequests {
+			r.end(d, fmt.Errorf("%w: %d of %d chunks still missing after %d retransmission requests",
+				ErrIncompleteTransfer, len(missingSeq), r.metadata.NumChunks, maxMissingRequests))
+			return
+		}
+		r.missingRequests++
+		r.log.Info("file has missing data in sequence, requesting resend of data", "missing", len(missingSeq), "attempt", r.missingRequests)
+		if err := requestMissingChunks(d, missingSeq); err != nil {
+			r.end(d, fmt.Errorf("unable to request missing chunks: %w", err))
+		}
+	case r.metadata == nil:
+		r.log.Error("ignoring message received before the file metadata")
+	default:
+		packet, err := unmarshallFilePacket(msg.Data)
+		if err != nil {
+			r.log.Error("unable to parse file packet", "error", err.Error())
+			return
+		}
+		if packet.SequenceNumber >= r.metadata.NumChunks {
+			r.log.Error("ignoring file packet out of range", "seq", packet.SequenceNumber, "chunks", r.metadata.NumChunks)
+			return
+		}
+		if _, ok := r.chunks[packet.SequenceNumber]; ok {
+			return
+		}
+		if r.bytesReceived+int64(len(packet.Data)) > r.metadata.FileSize {
+			r.end(d, fmt.Errorf("%w: chunk %d takes the file past its size of %d bytes",
+				ErrMalformedMessage, packet.SequenceNumber, r.metadata.FileSize))
+			return
+		}
+		r.chunks[packet.SequenceNumber] = packet
+		r.bytesReceived += int64(len(packet.Data))
+		if r.progress != nil {
+			r.progress(Progress{Bytes: r.bytesReceived, Total: r.metadata.FileSize})
+		}
+	}
+}
+
+// end passes the result of the transfer to finish and sends it to the
+// sender over d, later messages are ignored
+func (r *receiver) end(d dataChannel, err error) {
+	r.finished = true
+	result, _ := json.Marshal(newCollectorResult(err))
+	if sendErr := d.SendText(string(result)); sendErr != nil {
+		r.log.Error("unable to send the result to the sender", "error", sendErr)
+	}
+	r.finish(err)
+}
+
+// verify checks the chunks against the hash sent with the metadata
+func (r *receiver) verify() error {
+	h := sha256.New()
+	for i := range r.metadata.NumChunks {
+		h.Write(r.chunks[i].Data)
+	}
+	v := Verification{Expected: r.metadata.SHA256, SHA256: hex.EncodeToString(h.Sum(nil))}
+	if r.onVerified != nil {
+		r.onVerified(v)
+	}
+	if !v.OK() {
+		return fmt.Errorf("%w: expected sha256 %s but received %s", ErrChecksumMismatch, v.Expected, v.SHA256)
+	}
+	return nil
+}
+
+func (r *receiver) writeToSink() error {
+	if err := r.verify(); err != nil {
+		return err
+	}
+	w, err := r.sink.Create(*r.metadata)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSaveFailed, err)
+	}
+
+	for i := 0; i < r.metadata.NumChunks; i++ {
+		if _, err := w.Write(r.chunks[i].Data); err != nil {
+			w.Close()
+			return fmt.Errorf("%w: error writing chunk %d: %w", ErrSaveFailed, i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrSaveFailed, err)
+	}
+	return nil
+}
+
+// returns a map of the sequence of missing chunks and true if there are no missing chunks
+func (r *receiver) checkForMissingChunks() ([]int, bool) {
+	missingSeq := []int{}
+	for i := 0; i < r.metadata.NumChunks; i++ {
+		if _, ok := r.chunks[i]; !ok {
+			missingSeq = append(missingSeq, i)
+		}
+	}
+
+	if len(missingSeq) > 0 {
+		return missingSeq, false
+	}
+
+	return missingSeq, true
+}
+
+func requestMissingChunks(d dataChannel, missingSequences []int) error {
+	if len(missingSequences) > 0 {
+		request := MissingPacketRequest{MissingSequences: missingSequences}
+		requestBytes, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		err = d.Send(requestBytes)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,454 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshallMetadata(t *testing.T) {
+	metadata := FileMetadata{
+		FileName:  "testfile.txt",
+		FileSize:  12345,
+		NumChunks: 10,
+	}
+
+	jsonData, err := json.Marshal(metadata)
+	assert.NoError(t, err)
+
+	// Test the unmarshal function
+	result, err := unmarshallMetadata(jsonData)
+	assert.NoError(t, err)
+	assert.Equal(t, metadata, result)
+}
+
+func TestUnmarshallFilePacket(t *testing.T) {
+	packet := FilePacket{
+		SequenceNumber: 1,
+		Data:           []byte("chunk data"),
+	}
+
+	jsonData, err := json.Marshal(packet)
+	assert.NoError(t, err)
+
+	result, err := unmarshallFilePacket(jsonData)
+	assert.NoError(t, err)
+	assert.Equal(t, packet, result)
+}
+
+// Test checkForMissingChunks function
+func TestCheckForMissingChunks(t *testing.T) {
+	r := newReceiver(nil, slog.Default(), func(error) {})
+	r.metadata = &FileMetadata{NumChunks: 3}
+	r.chunks[0] = FilePacket{SequenceNumber: 0, Data: []byte("chunk1")}
+	r.chunks[2] = FilePacket{SequenceNumber: 2, Data: []byte("chunk3")}
+
+	// Case with missing chunks
+	missing, complete := r.checkForMissingChunks()
+	assert.Equal(t, []int{1}, missing)
+	assert.False(t, complete)
+
+	// Case with no missing chunks
+	r.chunks[1] = FilePacket{SequenceNumber: 1, Data: []byte("chunk2")}
+	missing, complete = r.checkForMissingChunks()
+	assert.Empty(t, missing)
+	assert.True(t, complete)
+}
+
+// namedReader is a Source held in memory
+type namedReader struct {
+	*bytes.Reader
+	name string
+}
+
+func (n namedReader) Name() string { return n.name }
+
+// recordingChannel keeps every message sent over it
+type recordingChannel struct {
+	sent []webrtc.DataChannelMessage
+}
+
+func (c *recordingChannel) Send(b []byte) error {
+	c.sent = append(c.sent, webrtc.DataChannelMessage{Data: b})
+	return nil
+}
+
+func (c *recordingChannel) SendText(s string) error {
+	c.sent = append(c.sent, webrtc.DataChannelMessage{IsString: true, Data: []byte(s)})
+	return nil
+}
+
+func TestSenderChunksSource(t *testing.T) {
+	src := namedReader{bytes.NewReader([]byte("0123456789")), "digits.txt"}
+	var progress []Progress
+	s := newSender(src, 4, slog.Default(), func(p Progress) { progress = append(progress, p) })
+	assert.Equal(t, FileMetadata{FileName: "digits.txt", FileSize: 10, NumChunks: 3}, s.metadata)
+
+	d := &recordingChannel{}
+	require.NoError(t, s.handleFileSending(d))
+	require.Len(t, d.sent, 5, "metadata, three chunks and done")
+	last, err := unmarshallFilePacket(d.sent[3].Data)
+	require.NoError(t, err)
+	assert.Equal(t, FilePacket{SequenceNumber: 2, Data: []byte("89")}, last)
+	assert.Equal(t, Progress{Bytes: 10, Total: 10}, progress[len(progress)-1], "the short last chunk counts its own length")
+
+	_, err = s.readChunk(3)
+	assert.Error(t, err)
+}
+
+func TestReceiverRequestsMissingChunks(t *testing.T) {
+	var out bytes.Buffer
+	var result error
+	finished := false
+	r := newReceiver(writerSink{&out}, slog.Default(), func(err error) {
+		result, finished = err, true
+	})
+
+	src := namedReader{bytes.NewReader([]byte("0123456789")), "digits.txt"}
+	s := newSender(src, 4, slog.Default(), nil)
+	fromSender := &recordingChannel{}
+	require.NoError(t, s.handleFileSending(fromSender))
+
+	toSender := &recordingChannel{}
+	for i, msg := range fromSender.sent {
+		// the second chunk is lost
+		if i != 2 {
+			r.HandleFileReception(toSender, msg)
+		}
+	}
+	require.Len(t, toSender.sent, 1)
+	request, err := unmashallMissingPacketRequest(toSender.sent[0].Data)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1}, request.MissingSequences)
+	assert.False(t, finished)
+
+	retransmitted := &recordingChannel{}
+	s.HandleRetransmission(retransmitted, toSender.sent[0])
+	for _, msg := range retransmitted.sent {
+		r.HandleFileReception(toSender, msg)
+	}
+	require.True(t, finished)
+	require.NoError(t, result)
+	assert.Equal(t, "0123456789", out.String())
+}
+
+type writerSink struct {
+	w *bytes.Buffer
+}
+
+func (s writerSink) Create(FileMetadata) (io.WriteCloser, error) {
+	return nopCloser{s.w}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func TestDirSinkKeepsFileInDirectory(t *testing.T) {
+	dir := t.TempDir()
+	w, err := DirSink{Dir: dir}.Create(FileMetadata{FileName: "../../escape.txt"})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.FileExists(t, filepath.Join(dir, "escape.txt"))
+
+	_, err = DirSink{Dir: dir}.Create(FileMetadata{FileName: ".."})
+	assert.Error(t, err)
+}
+
+func TestDirSinkOverwritePolicy(t *testing.T) {
+	m := FileMetadata{FileName: "report.pdf"}
+	create := func(sink DirSink, contents string) error {
+		w, err := sink.Create(m)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, contents)
+		return errors.Join(err, w.Close())
+	}
+	existing := func(t *testing.T) string {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "report.pdf"), []byte("old"), 0o600))
+		return dir
+	}
+
+	t.Run("always", func(t *testing.T) {
+		dir := existing(t)
+		require.NoError(t, create(DirSink{Dir: dir}, "new"))
+		data, _ := os.ReadFile(filepath.Join(dir, "report.pdf"))
+		assert.Equal(t, "new", string(data))
+	})
+
+	t.Run("never", func(t *testing.T) {
+		dir := existing(t)
+		err := create(DirSink{Dir: dir, Overwrite: OverwriteNever}, "new")
+		assert.True(t, errors.Is(err, ErrFileExists), "unexpected error: %v", err)
+		data, _ := os.ReadFile(filepath.Join(dir, "report.pdf"))
+		assert.Equal(t, "old", string(data))
+
+		require.NoError(t, create(DirSink{Dir: t.TempDir(), Overwrite: OverwriteNever}, "new"), "a new file is written")
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		dir := existing(t)
+		sink := DirSink{Dir: dir, Overwrite: OverwriteRename}
+		for _, want := range []string{"report (1).pdf", "report (2).pdf"} {
+			path, err := sink.Path(m)
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join(dir, want), path)
+			require.NoError(t, create(sink, "new"))
+			assert.FileExists(t, path)
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "report.pdf"))
+		assert.Equal(t, "old", string(data))
+	})
+}
+
+func TestUnmarshallMetadataRejectsImpossibleFiles(t *testing.T) {
+	tests := map[string]FileMetadata{
+		"negative size":            {FileSize: -1},
+		"negative chunks":          {FileSize: 10, NumChunks: -1},
+		"too many chunks":          {FileSize: 1 << 40, NumChunks: 1 << 31},
+		"chunks for an empty file": {NumChunks: 1},
+		"no chunks":                {FileSize: 10},
+		"more chunks than bytes":   {FileSize: 10, NumChunks: 11},
+	}
+	for name, metadata := range tests {
+		t.Run(name, func(t *testing.T) {
+			data, err := json.Marshal(metadata)
+			require.NoError(t, err)
+			_, err = unmarshallMetadata(data)
+			assert.ErrorIs(t, err, ErrMalformedMessage)
+		})
+	}
+}
+
+func TestReceiverRejectsInconsistentPackets(t *testing.T) {
+	var result error
+	r := newReceiver(writerSink{&bytes.Buffer{}}, slog.Default(), func(err error) { result = err })
+	d := &recordingChannel{}
+	metadata, err := json.Marshal(FileMetadata{FileName: "digits.txt", FileSize: 4, NumChunks: 2})
+	require.NoError(t, err)
+	r.HandleFileReception(d, webrtc.DataChannelMessage{Data: metadata})
+
+	send := func(p FilePacket) {
+		data, err := json.Marshal(p)
+		require.NoError(t, err)
+		r.HandleFileReception(d, webrtc.DataChannelMessage{Data: data})
+	}
+	send(FilePacket{SequenceNumber: 2, Data: []byte("xx")})
+	assert.Len(t, r.chunks, 0, "packets past the last chunk are ignored")
+	send(FilePacket{SequenceNumber: 0, Data: []byte("01")})
+	send(FilePacket{SequenceNumber: 1, Data: []byte("234")})
+	assert.ErrorIs(t, result, ErrMalformedMessage)
+	assert.True(t, r.finished)
+}
+
+func TestReceiverRejectsShortFile(t *testing.T) {
+	var result error
+	r := newReceiver(writerSink{&bytes.Buffer{}}, slog.Default(), func(err error) { result = err })
+	d := &recordingChannel{}
+	for _, msg := range []string{
+		`{"fileName":"digits.txt","fileSize":4,"numChunks":2}`,
+		`{"seq":0,"data":"MA=="}`,
+		`{"seq":1,"data":"MQ=="}`,
+	} {
+		r.HandleFileReception(d, webrtc.DataChannelMessage{Data: []byte(msg)})
+	}
+	r.HandleFileReception(d, webrtc.DataChannelMessage{IsString: true, Data: []byte(doneMessage)})
+	assert.ErrorIs(t, result, ErrMalformedMessage)
+}
+
+func FuzzUnmarshallMetadata(f *testing.F) {
+	f.Add([]byte(`{"fileName":"testfile.txt","fileSize":12345,"numChunks":10}`))
+	f.Add([]byte(`{"fileName":"","fileSize":0,"numChunks":0}`))
+	f.Add([]byte(`{"fileSize":2147483648,"numChunks":2147483648}`))
+	f.Add([]byte(`{"fileSize":-1,"numChunks":-1}`))
+	f.Add([]byte(`{"fileName":`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := unmarshallMetadata(data)
+		if err != nil {
+			return
+		}
+		if m.FileSize < 0 || m.NumChunks < 0 || m.NumChunks > maxChunks || int64(m.NumChunks) > m.FileSize {
+			t.Fatalf("accepted impossible metadata %+v", m)
+		}
+	})
+}
+
+func FuzzUnmarshallFilePacket(f *testing.F) {
+	f.Add([]byte(`{"seq":1,"data":"Y2h1bmsgZGF0YQ=="}`))
+	f.Add([]byte(`{"seq":-1,"data":""}`))
+	f.Add([]byte(`{"seq":9223372036854775807,"data":null}`))
+	f.Add([]byte(`{"seq":0,"data":"not base64"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := unmarshallFilePacket(data)
+		if err == nil && p.SequenceNumber < 0 {
+			t.Fatalf("accepted negative sequence number %d", p.SequenceNumber)
+		}
+	})
+}
+
+func FuzzUnmarshallMissingPacketRequest(f *testing.F) {
+	f.Add([]byte(`{"missingSequences":[1,2,3]}`))
+	f.Add([]byte(`{"missingSequences":[]}`))
+	f.Add([]byte(`{"missingSequences":[-1]}`))
+	f.Add([]byte(`{"missingSequences":null}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		mp, err := unmashallMissingPacketRequest(data)
+		if err != nil {
+			return
+		}
+		for _, seq := range mp.MissingSequences {
+			if seq < 0 {
+				t.Fatalf("accepted negative sequence number %d", seq)
+			}
+		}
+	})
+}
+
+// FuzzHandleFileReception sends the metadata, a packet twice and the done
+// message, as text or binary, to a receiver
+func FuzzHandleFileReception(f *testing.F) {
+	f.Add([]byte(`{"fileName":"a.txt","fileSize":2,"numChunks":1}`), []byte(`{"seq":0,"data":"MDE="}`), false)
+	f.Add([]byte(`{"fileName":"a.txt","fileSize":0,"numChunks":0}`), []byte(`done`), true)
+	f.Add([]byte(`{"fileName":"a.txt","fileSize":4,"numChunks":4194304}`), []byte(`{"seq":4194303,"data":"MDE="}`), false)
+	f.Add([]byte(`{"seq":0,"data":"MDE="}`), []byte(`{"fileName":"a.txt","fileSize":2,"numChunks":1}`), true)
+
+	f.Fuzz(func(t *testing.T, metadata, packet []byte, text bool) {
+		var out bytes.Buffer
+		var result error
+		finished := 0
+		r := newReceiver(writerSink{&out}, slog.New(slog.NewTextHandler(io.Discard, nil)), func(err error) {
+			result = err
+			finished++
+		})
+		r.progress = func(p Progress) {
+			if p.Bytes > p.Total {
+				t.Fatalf("received %d bytes of a %d byte file", p.Bytes, p.Total)
+			}
+		}
+
+		d := &recordingChannel{}
+		r.HandleFileReception(d, webrtc.DataChannelMessage{Data: metadata})
+		r.HandleFileReception(d, webrtc.DataChannelMessage{IsString: text, Data: packet})
+		r.HandleFileReception(d, webrtc.DataChannelMessage{IsString: text, Data: packet})
+		r.HandleFileReception(d, webrtc.DataChannelMessage{IsString: true, Data: []byte(doneMessage)})
+
+		if finished > 1 {
+			t.Fatalf("finish called %d times", finished)
+		}
+		if finished == 1 && result == nil && int64(out.Len()) != r.metadata.FileSize {
+			t.Fatalf("wrote %d bytes of a %d byte file", out.Len(), r.metadata.FileSize)
+		}
+		if len(r.chunks) > 1 {
+			t.Fatalf("kept %d chunks from a single packet", len(r.chunks))
+		}
+	})
+}
+
+func TestReceiverVerifiesChecksum(t *testing.T) {
+	s := newSender(namedReader{bytes.NewReader([]byte("0123456789")), "digits.txt"}, 4, slog.Default(), nil)
+	require.NoError(t, s.hash())
+	assert.Equal(t, "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", s.metadata.SHA256)
+	fromSender := &recordingChannel{}
+	require.NoError(t, s.handleFileSending(fromSender))
+
+	receive := func(tamper bool) (Verification, string, error) {
+		var out bytes.Buffer
+		var result error
+		var verification Verification
+		r := newReceiver(writerSink{&out}, slog.Default(), func(err error) { result = err })
+		r.onVerified = func(v Verification) { verification = v }
+		for i, msg := range fromSender.sent {
+			if tamper && i == 1 {
+				msg.Data = bytes.Replace(msg.Data, []byte(`"MDEyMw=="`), []byte(`"MDEyNA=="`), 1)
+			}
+			r.HandleFileReception(&recordingChannel{}, msg)
+		}
+		return verification, out.String(), result
+	}
+
+	v, out, err := receive(false)
+	require.NoError(t, err)
+	assert.True(t, v.Checked())
+	assert.True(t, v.OK())
+	assert.Equal(t, s.metadata.SHA256, v.SHA256)
+	assert.Equal(t, "0123456789", out)
+
+	v, out, err = receive(true)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.False(t, v.OK())
+	assert.Empty(t, out, "a file which does not match is not written")
+}
+
+func TestCollectorReportsResult(t *testing.T) {
+	tests := map[string]struct {
+		err, want error
+	}{
+		"saved":         {nil, nil},
+		"checksum":      {fmt.Errorf("%w: expected sha256 a but received b", ErrChecksumMismatch), ErrChecksumMismatch},
+		"save failed":   {fmt.Errorf("%w: %w: out/in.bin", ErrSaveFailed, ErrFileExists), ErrSaveFailed},
+		"incomplete":    {fmt.Errorf("%w: 3 of 10 chunks still missing", ErrIncompleteTransfer), ErrIncompleteTransfer},
+		"other failure": {errors.New("sender finished without sending the file metadata"), ErrTransferAborted},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var result error
+			r := newReceiver(nil, slog.Default(), func(err error) { result = err })
+			d := &recordingChannel{}
+			r.end(d, tt.err)
+			assert.Equal(t, tt.err, result)
+
+			require.Len(t, d.sent, 1)
+			require.True(t, d.sent[0].IsString, "the result is a text message")
+			reported := unmarshallCollectorResult(d.sent[0].Data)
+			if tt.want == nil {
+				assert.NoError(t, reported)
+				return
+			}
+			assert.ErrorIs(t, reported, tt.want)
+			assert.ErrorContains(t, reported, tt.err.Error())
+		})
+	}
+
+	assert.ErrorIs(t, unmarshallCollectorResult([]byte("done")), ErrMalformedMessage)
+}
+
+// failingSink cannot create any file
+type failingSink struct{}
+
+func (failingSink) Create(FileMetadata) (io.WriteCloser, error) {
+	return nil, &os.PathError{Op: "open", Path: "out/digits.txt", Err: os.ErrPermission}
+}
+
+func TestReceiverReportsSaveFailure(t *testing.T) {
+	s := newSender(namedReader{bytes.NewReader([]byte("0123456789")), "digits.txt"}, 4, slog.Default(), nil)
+	fromSender := &recordingChannel{}
+	require.NoError(t, s.handleFileSending(fromSender))
+
+	var result error
+	r := newReceiver(failingSink{}, slog.Default(), func(err error) { result = err })
+	toSender := &recordingChannel{}
+	for _, msg := range fromSender.sent {
+		r.HandleFileReception(toSender, msg)
+	}
+	assert.ErrorIs(t, result, ErrSaveFailed)
+	assert.ErrorIs(t, result, os.ErrPermission)
+	require.Len(t, toSender.sent, 1)
+	assert.ErrorIs(t, unmarshallCollectorResult(toSender.sent[0].Data), ErrSaveFailed)
+}
@@ -0,0 +1,224 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// endpoint is one direction of an in-memory data channel, messages are
+// handled one at a time in the order they were sent
+type endpoint struct {
+	queue chan webrtc.DataChannelMessage
+}
+
+func newEndpoint(handle func(webrtc.DataChannelMessage)) *endpoint {
+	e := &endpoint{queue: make(chan webrtc.DataChannelMessage, 1<<12)}
+	go func() {
+		for msg := range e.queue {
+			handle(msg)
+		}
+	}()
+	return e
+}
+
+func (e *endpoint) Send(data []byte) error {
+	e.queue <- webrtc.DataChannelMessage{Data: bytes.Clone(data)}
+	return nil
+}
+
+func (e *endpoint) SendText(s string) error {
+	e.queue <- webrtc.DataChannelMessage{IsString: true, Data: []byte(s)}
+	return nil
+}
+
+// faultyChannel drops, reorders and duplicates the file packets sent through
+// it at the given rates, the metadata and done messages are passed through.
+// It is only used by the sender, which sends one message at a time.
+type faultyChannel struct {
+	dataChannel
+	rng                      *rand.Rand
+	drop, reorder, duplicate float64
+	// held packets are delivered after the next message, so a packet held
+	// before the done message arrives after it
+	held [][]byte
+
+	dropped, reordered, duplicated int
+}
+
+func isFilePacket(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return false
+	}
+	_, ok := fields["seq"]
+	return ok
+}
+
+func (f *faultyChannel) Send(data []byte) error {
+	if !isFilePacket(data) {
+		return f.dataChannel.Send(data)
+	}
+
+	switch r := f.rng.Float64(); {
+	case r < f.drop:
+		f.dropped++
+		return nil
+	case r < f.drop+f.reorder:
+		f.reordered++
+		f.held = append(f.held, data)
+		return nil
+	}
+	if err := f.dataChannel.Send(data); err != nil {
+		return err
+	}
+	if f.rng.Float64() < f.duplicate {
+		f.duplicated++
+		if err := f.dataChannel.Send(data); err != nil {
+			return err
+		}
+	}
+	return f.release()
+}
+
+func (f *faultyChannel) SendText(s string) error {
+	if err := f.dataChannel.SendText(s); err != nil {
+		return err
+	}
+	return f.release()
+}
+
+func (f *faultyChannel) release() error {
+	held := f.held
+	f.held = nil
+	for _, data := range held {
+		if err := f.dataChannel.Send(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type faults struct {
+	drop, reorder, duplicate float64
+}
+
+// lossyTransfer sends data from a sender to a receiver over a channel which
+// injects faults into the file packets, returning what the receiver wrote,
+// the channel and the receiver's result, which the sender must be told
+func lossyTransfer(t *testing.T, data []byte, chunkSize int, fs faults, seed int64) ([]byte, *faultyChannel, error) {
+	t.Helper()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	var written bytes.Buffer
+	done := make(chan error, 1)
+	reported := make(chan error, 1)
+
+	snd := newSender(namedReader{bytes.NewReader(data), "lossy.bin"}, chunkSize, log, nil)
+	rcv := newReceiver(writerSink{&written}, log, func(err error) { done <- err })
+
+	// each side replies over the other's endpoint, as a data channel does, and
+	// the first pass and retransmissions share the same faulty channel
+	var toSender *endpoint
+	toReceiver := newEndpoint(func(msg webrtc.DataChannelMessage) {
+		rcv.HandleFileReception(toSender, msg)
+	})
+	channel := &faultyChannel{
+		dataChannel: toReceiver,
+		rng:         rand.New(rand.NewSource(seed)),
+		drop:        fs.drop,
+		reorder:     fs.reorder,
+		duplicate:   fs.duplicate,
+	}
+	toSender = newEndpoint(func(msg webrtc.DataChannelMessage) {
+		if msg.IsString {
+			reported <- unmarshallCollectorResult(msg.Data)
+			return
+		}
+		snd.HandleRetransmission(channel, msg)
+	})
+	t.Cleanup(func() {
+		close(toSender.queue)
+		close(toReceiver.queue)
+	})
+
+	go func() {
+		if err := snd.handleFileSending(channel); err != nil {
+			done <- err
+		}
+	}()
+
+	select {
+	case err := <-done:
+		select {
+		case result := <-reported:
+			if err == nil {
+				assert.NoError(t, result)
+			} else {
+				assert.ErrorContains(t, result, err.Error())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the sender was not told the result")
+		}
+		// the sender may still be releasing held packets
+		snd.sendMu.Lock()
+		defer snd.sendMu.Unlock()
+		return written.Bytes(), channel, err
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer did not finish or fail in time")
+		return nil, nil, nil
+	}
+}
+
+func TestTransferRecoversFromFaults(t *testing.T) {
+	const chunkSize = 512
+	tests := map[string]faults{
+		"no faults":          {},
+		"dropped packets":    {drop: 0.1},
+		"mostly dropped":     {drop: 0.6},
+		"reordered packets":  {reorder: 0.2},
+		"duplicated packets": {duplicate: 0.2},
+		"every fault":        {drop: 0.15, reorder: 0.15, duplicate: 0.15},
+	}
+
+	for name, fs := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, size := range []int{1, chunkSize, 40*chunkSize + 17} {
+				t.Run(fmt.Sprint(size), func(t *testing.T) {
+					data := make([]byte, size)
+					rand.New(rand.NewSource(int64(size))).Read(data)
+
+					written, channel, err := lossyTransfer(t, data, chunkSize, fs, 1)
+					require.NoError(t, err)
+					assert.True(t, bytes.Equal(data, written), "the file written differs from the one sent")
+					if size > chunkSize {
+						assert.Equal(t, fs.drop > 0, channel.dropped > 0, "dropped %d", channel.dropped)
+						assert.Equal(t, fs.reorder > 0, channel.reordered > 0, "reordered %d", channel.reordered)
+						assert.Equal(t, fs.duplicate > 0, channel.duplicated > 0, "duplicated %d", channel.duplicated)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestTransferFailsWhenChunksNeverArrive(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 10*512)
+	start := time.Now()
+	written, channel, err := lossyTransfer(t, data, 512, faults{drop: 1}, 1)
+
+	assert.True(t, errors.Is(err, ErrIncompleteTransfer), "unexpected error: %v", err)
+	assert.ErrorContains(t, err, "10 of 10 chunks still missing")
+	assert.Empty(t, written, "nothing should be written for an incomplete file")
+	assert.Equal(t, 10*(maxMissingRequests+1), channel.dropped, "every chunk is sent once and then once per request")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,140 @@
+package transfer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// healthTimeout bounds the request to the relay's health check made to
+// explain a failed connection
+const healthTimeout = 5 * time.Second
+
+// ParseRelayURL parses the address of a relay server as a person would type
+// it. The scheme defaults to wss, or ws for localhost, http and https are
+// replaced by ws and wss, and /ws is used when there is no path, so
+// adit.example.com becomes wss://adit.example.com/ws.
+func ParseRelayURL(s string) (url.URL, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return url.URL{}, errors.New("the relay server address is empty")
+	}
+	raw := s
+	if !strings.Contains(s, "://") {
+		s = "//" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return url.URL{}, fmt.Errorf("invalid relay server address %q: %w", raw, err)
+	}
+	if u.Host == "" {
+		return url.URL{}, fmt.Errorf("the relay server address %q has no host", raw)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "":
+		u.Scheme = "wss"
+		if isLoopback(u.Hostname()) {
+			u.Scheme = "ws"
+		}
+	case "ws", "http":
+		u.Scheme = "ws"
+	case "wss", "https":
+		u.Scheme = "wss"
+	default:
+		return url.URL{}, fmt.Errorf("the relay server address %s must use ws, wss, http or https", u.Redacted())
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/ws"
+	}
+	u.Fragment = ""
+	return *u, nil
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dialError describes why the websocket to the relay could not be opened,
+// in place of the error from dialing it wraps
+type dialError struct {
+	description string
+	err         error
+}
+
+func (e dialError) Error() string { return e.description }
+func (e dialError) Unwrap() error { return e.err }
+
+// describeDialError explains why the websocket to the relay at u could not
+// be opened, resp is the server's answer if it gave one
+func describeDialError(u url.URL, err error, resp *http.Response) error {
+	return dialError{dialErrorDescription(u, err, resp), err}
+}
+
+func dialErrorDescription(u url.URL, err error, resp *http.Response) string {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return fmt.Sprintf("the host %s could not be found, check the address", u.Hostname())
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Sprintf("nothing is accepting connections at %s, check the port and that the relay server is running", u.Host)
+	case errors.As(err, &recordErr):
+		return "the server did not answer with TLS, use ws:// if the relay server does not have TLS enabled"
+	case errors.As(err, &certErr):
+		return fmt.Sprintf("the TLS certificate of %s could not be verified: %v", u.Hostname(), certErr.Err)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Sprintf("timed out connecting to %s", u.Host)
+	case errors.Is(err, websocket.ErrBadHandshake) && resp != nil:
+		return fmt.Sprintf("the server answered %s instead of opening a websocket", resp.Status)
+	}
+	return err.Error()
+}
+
+// probeHealth requests the health check next to the relay's websocket to
+// explain why the server at u answered but did not open the websocket
+func probeHealth(u url.URL, auth RelayAuth) string {
+	health := url.URL{Scheme: "http", Host: u.Host, Path: path.Join(path.Dir(u.Path), "health")}
+	if u.Scheme == "wss" {
+		health.Scheme = "https"
+	}
+	client := &http.Client{
+		Timeout:   healthTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{Certificates: auth.Certificates}},
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(health.String())
+	if err != nil {
+		return fmt.Sprintf("its health check at %s could not be reached: %v", health.String(), err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return fmt.Sprintf("the relay server is running, check the path %s of its websocket which is usually /ws", u.Path)
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return "the relay server is not accepting transfers, it may be restarting"
+	case resp.StatusCode == http.StatusBadRequest && u.Scheme == "ws":
+		// as a server with TLS answers a request without it
+		return "the server may only accept TLS connections, use wss://"
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Sprintf("it has no health check at %s so may not be an adit relay server", health.String())
+	}
+	return fmt.Sprintf("its health check at %s answered %s", health.String(), resp.Status)
+}
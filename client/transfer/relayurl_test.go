@@ -0,0 +1,137 @@
+package transfer
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRelayURL(t *testing.T) {
+	tests := map[string]string{
+		"adit.example.com":                  "wss://adit.example.com/ws",
+		"adit.example.com/":                 "wss://adit.example.com/ws",
+		"adit.example.com:8443":             "wss://adit.example.com:8443/ws",
+		"adit.example.com/relay/ws":         "wss://adit.example.com/relay/ws",
+		"https://adit.example.com":          "wss://adit.example.com/ws",
+		"http://adit.example.com:8080":      "ws://adit.example.com:8080/ws",
+		"HTTPS://adit.example.com/ws":       "wss://adit.example.com/ws",
+		"wss://adit.example.com/ws":         "wss://adit.example.com/ws",
+		"ws://adit.example.com/ws?region=1": "ws://adit.example.com/ws?region=1",
+		"localhost:8080":                    "ws://localhost:8080/ws",
+		"127.0.0.1:8080":                    "ws://127.0.0.1:8080/ws",
+		"[::1]:8080":                        "ws://[::1]:8080/ws",
+		"wss://localhost:8443":              "wss://localhost:8443/ws",
+		"  adit.example.com  ":              "wss://adit.example.com/ws",
+	}
+	for in, want := range tests {
+		t.Run(in, func(t *testing.T) {
+			u, err := ParseRelayURL(in)
+			require.NoError(t, err)
+			assert.Equal(t, want, u.String())
+		})
+	}
+}
+
+func TestParseRelayURLRejectsInvalidAddresses(t *testing.T) {
+	tests := map[string]string{
+		"":                          "empty",
+		"ftp://adit.example.com":    "must use ws, wss, http or https",
+		"wss://":                    "has no host",
+		"adit.example.com:port/ws":  "invalid relay server address",
+		"https:///ws":               "has no host",
+		"wss://adit.example.com%zz": "invalid relay server address",
+	}
+	for in, want := range tests {
+		t.Run(in, func(t *testing.T) {
+			_, err := ParseRelayURL(in)
+			assert.ErrorContains(t, err, want)
+		})
+	}
+}
+
+// connectTo connects to the relay at raw, which must fail
+func connectTo(t *testing.T, raw string) error {
+	t.Helper()
+	u, err := ParseRelayURL(raw)
+	require.NoError(t, err)
+	_, err = connectRelay(u, RelayAuth{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrRelayUnreachable), "unexpected error: %v", err)
+	return err
+}
+
+func TestConnectRelayDiagnosesServer(t *testing.T) {
+	tests := map[string]struct {
+		health int
+		want   string
+	}{
+		"wrong path":     {http.StatusOK, "the relay server is running, check the path /wrong of its websocket"},
+		"draining":       {http.StatusServiceUnavailable, "the relay server is not accepting transfers"},
+		"not a relay":    {http.StatusNotFound, "so may not be an adit relay server"},
+		"other response": {http.StatusTeapot, "answered 418 I'm a teapot"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/health" {
+					w.WriteHeader(tt.health)
+					return
+				}
+				http.NotFound(w, r)
+			}))
+			t.Cleanup(server.Close)
+
+			err := connectTo(t, server.URL+"/wrong")
+			assert.ErrorContains(t, err, "the server answered 404 Not Found instead of opening a websocket")
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestConnectRelayDiagnosesConnection(t *testing.T) {
+	t.Run("refused", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := l.Addr().String()
+		l.Close()
+
+		err = connectTo(t, addr)
+		assert.ErrorContains(t, err, "nothing is accepting connections at "+addr)
+	})
+
+	t.Run("no TLS", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		t.Cleanup(server.Close)
+
+		err := connectTo(t, "wss://"+strings.TrimPrefix(server.URL, "http://"))
+		assert.ErrorContains(t, err, "the server did not answer with TLS, use ws://")
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		t.Cleanup(server.Close)
+
+		err := connectTo(t, server.URL)
+		assert.ErrorContains(t, err, "the TLS certificate of 127.0.0.1 could not be verified")
+	})
+
+	t.Run("TLS expected", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.NotFoundHandler())
+		t.Cleanup(server.Close)
+
+		u, err := url.Parse(server.URL)
+		require.NoError(t, err)
+		err = connectTo(t, "ws://"+u.Host)
+		assert.ErrorContains(t, err, "the server answered 400 Bad Request")
+		assert.ErrorContains(t, err, "the server may only accept TLS connections, use wss://")
+	})
+}
@@ -0,0 +1,501 @@
+// Package transfer sends and receives files between two peers over WebRTC,
+// using an adit relay server to exchange the connection details.
+//
+// The sender calls Send, is given a code by the relay through
+// Options.OnCode and passes it to the collector, which calls Receive with
+// it. Both return once the file has been saved by the collector or the
+// transfer fails.
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultRelay is the public relay server
+var DefaultRelay = url.URL{Scheme: "wss", Host: "adit.rharris.dev", Path: "/ws"}
+
+// DefaultSTUNServers are used to discover public addresses when
+// Options.STUNServers is nil
+var DefaultSTUNServers = []string{
+	"stun:stun.l.google.com:19302",
+	"stun:stun1.l.google.com:19302",
+	"stun:stun2.l.google.com:19302",
+	"stun:stun3.l.google.com:19302",
+	"stun:stun4.l.google.com:19302",
+}
+
+const (
+	DefaultChunkSize   = 16384
+	DefaultPeerTimeout = 10 * time.Minute
+)
+
+var (
+	// ErrRelayUnreachable is returned when no connection can be made to the
+	// relay server
+	ErrRelayUnreachable = errors.New("error connecting to relay server")
+	// ErrPeerDisconnected is returned when the relay reports that the other
+	// side of the transfer lost its connection before the transfer was set up
+	ErrPeerDisconnected = errors.New("the other side of the transfer disconnected, please start the transfer again")
+	// ErrPeerConnectionFailed is returned when the peers cannot connect to
+	// each other or lose the connection during the transfer
+	ErrPeerConnectionFailed = errors.New("unable to establish connection to peer")
+	// ErrPeerTimeout is returned when the other peer does not connect within
+	// Options.PeerTimeout
+	ErrPeerTimeout = errors.New("timed out waiting for the other side of the transfer")
+	// ErrTransferAborted is returned by Send when the collector closes the
+	// connection before the whole file has been sent
+	ErrTransferAborted = errors.New("the transfer was stopped before the file was sent")
+	// ErrIncompleteTransfer is returned by Receive when chunks of the file
+	// are still missing after they have been requested again several times
+	ErrIncompleteTransfer = errors.New("the file did not arrive complete")
+	// ErrChecksumMismatch is returned by Receive when the file received does
+	// not match the hash sent by the sender, it is not written to the Sink.
+	// Send returns it when the collector reports the mismatch.
+	ErrChecksumMismatch = errors.New("the file received does not match the one sent")
+	// ErrMalformedMessage is wrapped by errors for messages from the other
+	// peer which cannot be valid for the file being transferred
+	ErrMalformedMessage = errors.New("malformed message from the other peer")
+	// ErrSaveFailed is returned by Receive when the Sink cannot create or
+	// write the file, and by Send when the collector reports it could not
+	ErrSaveFailed = errors.New("unable to save the file")
+	// ErrFileExists is returned by DirSink when the file received would
+	// replace an existing one and its OverwritePolicy does not allow it
+	ErrFileExists = errors.New("a file with that name already exists")
+	// ErrCustomCodeUnsupported is returned when Options.Code or
+	// Options.Words is set but the relay always generates its own code
+	ErrCustomCodeUnsupported = errors.New("the relay server does not support choosing the code")
+)
+
+// Options configures a transfer, the zero value uses the public relay
+type Options struct {
+	// Relay is the websocket URL of the relay server, DefaultRelay is used
+	// when it is empty
+	Relay url.URL
+	Auth  RelayAuth
+	// STUNServers are used to discover public addresses, DefaultSTUNServers
+	// when nil. An empty slice gathers host candidates only.
+	STUNServers []string
+	// ICEServers are STUN and TURN servers used in place of STUNServers
+	// when set, for servers which need credentials
+	ICEServers []ICEServer
+	// IncludeLoopback gathers candidates on the loopback interface, so two
+	// peers on the same host can connect without any other network
+	IncludeLoopback bool
+	// ChunkSize is the size in bytes of each message sent to the collector,
+	// only used by the sender
+	ChunkSize int
+	// PeerTimeout bounds the wait for the other peer, not the transfer
+	PeerTimeout time.Duration
+
+	// Code requests a specific code from the relay, or Words a generated
+	// code with that many words. Only used by the sender.
+	Code  string
+	Words int
+
+	// OnCode is called with the code once the relay has issued it, it must
+	// be passed to the collector
+	OnCode func(code string)
+	// OnConnected is called once the data channel to the peer is open
+	OnConnected func()
+	// OnFile is called with the metadata of the file once the collector
+	// has connected and before it is sent, or once the collector has
+	// received it
+	OnFile func(FileMetadata)
+	// OnProgress is called after each chunk is sent or received
+	OnProgress func(Progress)
+	// OnVerified is called by Receive once every chunk has arrived, with the
+	// result of checking the file against the hash sent by the sender
+	OnVerified func(Verification)
+
+	// Logger receives diagnostics, slog.Default() is used when nil
+	Logger *slog.Logger
+}
+
+// ICEServer is a STUN or TURN server, TURN servers need the username and
+// credential
+type ICEServer struct {
+	URLs       []string
+	Username   string
+	Credential string
+}
+
+// iceServers returns the servers to gather candidates with
+func (o Options) iceServers() []webrtc.ICEServer {
+	if len(o.ICEServers) == 0 {
+		if len(o.STUNServers) == 0 {
+			return nil
+		}
+		return []webrtc.ICEServer{{URLs: o.STUNServers}}
+	}
+	servers := make([]webrtc.ICEServer, 0, len(o.ICEServers))
+	for _, s := range o.ICEServers {
+		servers = append(servers, webrtc.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential})
+	}
+	return servers
+}
+
+// Progress is the number of bytes of the file transferred so far
+type Progress struct {
+	Bytes int64
+	Total int64
+}
+
+func (o Options) withDefaults() Options {
+	if o.Relay == (url.URL{}) {
+		o.Relay = DefaultRelay
+	}
+	if o.STUNServers == nil {
+		o.STUNServers = DefaultSTUNServers
+	}
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.PeerTimeout <= 0 {
+		o.PeerTimeout = DefaultPeerTimeout
+	}
+	if o.Logger == nil {
+		o.Logger = slog.Default()
+	}
+	return o
+}
+
+// Source is a file to send
+type Source interface {
+	io.ReaderAt
+	// Name is the file name given to the collector
+	Name() string
+	Size() int64
+}
+
+// File is a Source read from disk
+type File struct {
+	*os.File
+	size int64
+}
+
+// OpenFile opens the file at path to send it, it must be closed once the
+// transfer is over
+func OpenFile(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	return &File{File: f, size: info.Size()}, nil
+}
+
+// Name returns the base name of the file
+func (f *File) Name() string {
+	return filepath.Base(f.File.Name())
+}
+
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Sink is where a received file is written
+type Sink interface {
+	// Create is called with the metadata of the file once every chunk has
+	// arrived, the file is written to the returned writer which is then
+	// closed
+	Create(FileMetadata) (io.WriteCloser, error)
+}
+
+// OverwritePolicy is what DirSink does when the file received has the same
+// name as one already in the directory
+type OverwritePolicy string
+
+const (
+	// OverwriteAlways replaces the existing file, it is used when the
+	// policy is empty
+	OverwriteAlways OverwritePolicy = "always"
+	// OverwriteNever fails with ErrFileExists
+	OverwriteNever OverwritePolicy = "never"
+	// OverwriteRename writes the file under a free name, adding a number
+	// before its extension such as report (1).pdf
+	OverwriteRename OverwritePolicy = "rename"
+)
+
+// ParseOverwritePolicy returns the policy named s
+func ParseOverwritePolicy(s string) (OverwritePolicy, error) {
+	switch p := OverwritePolicy(s); p {
+	case OverwriteAlways, OverwriteNever, OverwriteRename:
+		return p, nil
+	}
+	return "", fmt.Errorf("overwrite policy %q is not one of always, never or rename", s)
+}
+
+// maxRenames bounds the numbers tried for a free name with OverwriteRename
+const maxRenames = 1000
+
+// DirSink writes the received file to a directory
+type DirSink struct {
+	Dir string
+	// Name replaces the name given by the sender when set
+	Name      string
+	Overwrite OverwritePolicy
+}
+
+// Path returns where the file with metadata m is written. With
+// OverwriteRename it depends on the files in the directory, so it is only
+// the path the file would be written to if it was created now.
+func (s DirSink) Path(m FileMetadata) (string, error) {
+	name := s.Name
+	if name == "" {
+		// the name comes from the sender and must not escape the directory
+		name = filepath.Base(filepath.Clean("/" + m.FileName))
+		if name == "/" || name == "." {
+			return "", fmt.Errorf("%w: the sender gave an invalid file name %q", ErrMalformedMessage, m.FileName)
+		}
+	}
+	path := filepath.Join(s.Dir, name)
+	if s.Overwrite != OverwriteRename {
+		return path, nil
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; exists(path); i++ {
+		if i > maxRenames {
+			return "", fmt.Errorf("%w: no free name found for %s", ErrFileExists, filepath.Join(s.Dir, name))
+		}
+		path = filepath.Join(s.Dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+	return path, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func (s DirSink) Create(m FileMetadata) (io.WriteCloser, error) {
+	path, err := s.Path(m)
+	if err != nil {
+		return nil, err
+	}
+	if s.Overwrite == "" || s.Overwrite == OverwriteAlways {
+		return os.Create(path)
+	}
+	// the file is not replaced if it was created since Path looked
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%w: %s", ErrFileExists, path)
+	}
+	return f, err
+}
+
+// session holds what the sender and collector share while setting up the
+// connection
+type session struct {
+	opts Options
+	ws   *socket
+	rtc  *peerConnection
+	// done receives the result of the transfer
+	done chan error
+}
+
+func newSession(ctx context.Context, opts Options) (*session, error) {
+	ws, err := connectRelay(opts.Relay, opts.Auth, opts.Logger)
+	if err != nil {
+		return nil, err
+	}
+	ws.onCode = opts.OnCode
+	go ws.keepAlive(ctx)
+
+	rtc, err := newPeerConnection(opts.iceServers(), opts.IncludeLoopback, opts.Logger)
+	if err != nil {
+		ws.closeConn()
+		return nil, fmt.Errorf("%w: unable to create peer connection: %w", ErrPeerConnectionFailed, err)
+	}
+
+	s := &session{opts: opts, ws: ws, rtc: rtc, done: make(chan error, 1)}
+	rtc.HandleChanges(ws, s.finish)
+
+	// registered before the offer or answer is created so that no
+	// candidates are missed, the socket queues them until it has a phrase
+	rtc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil {
+			if err := ws.SendIceCandidate(candidate); err != nil {
+				opts.Logger.Error("unable to send ice candidate", "error", err.Error())
+			}
+		}
+	})
+	go ws.HandleIncomingMessages(ctx, rtc)
+	return s, nil
+}
+
+// finish records the result of the transfer, only the first is kept
+func (s *session) finish(err error) {
+	select {
+	case s.done <- err:
+	default:
+	}
+}
+
+func (s *session) close() {
+	if err := s.rtc.Close(); err != nil {
+		s.opts.Logger.Error("unable to close peer connection", "error", err)
+	}
+	s.ws.closeConn()
+}
+
+// wait blocks until the transfer is over
+func (s *session) wait(ctx context.Context) error {
+	select {
+	case err := <-s.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send offers src to a collector, returning once the collector has saved it
+func Send(ctx context.Context, src Source, opts Options) error {
+	opts = opts.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the file is hashed before a code is issued so the collector is not
+	// kept waiting for it
+	snd := newSender(src, opts.ChunkSize, opts.Logger, opts.OnProgress)
+	if err := snd.hash(); err != nil {
+		return err
+	}
+
+	s, err := newSession(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	var sent atomic.Bool
+	dc, err := s.rtc.CreateDataChannel("dataChannel", nil)
+	if err != nil {
+		return fmt.Errorf("%w: unable to create data channel: %w", ErrPeerConnectionFailed, err)
+	}
+	channel := newFlowControl(dc)
+	dc.OnOpen(func() {
+		if opts.OnConnected != nil {
+			opts.OnConnected()
+		}
+		if opts.OnFile != nil {
+			opts.OnFile(snd.metadata)
+		}
+		if err := snd.handleFileSending(channel); err != nil {
+			s.finish(err)
+			return
+		}
+		sent.Store(true)
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		// the collector's only text message is its result
+		if msg.IsString {
+			s.finish(unmarshallCollectorResult(msg.Data))
+			return
+		}
+		snd.HandleRetransmission(channel, msg)
+	})
+	// collectors which do not send their result close the connection once
+	// they have saved the file
+	dc.OnClose(func() {
+		channel.close()
+		if !sent.Load() {
+			s.finish(fmt.Errorf("%w: the collector closed the connection", ErrTransferAborted))
+			return
+		}
+		s.finish(nil)
+	})
+
+	offerSDP, err := s.rtc.CreateOffer()
+	if err != nil {
+		return fmt.Errorf("%w: unable to create offer: %w", ErrPeerConnectionFailed, err)
+	}
+	if err := s.ws.SendOffer(offerSDP, opts.Code, opts.Words); err != nil {
+		return fmt.Errorf("unable to send offer: %w", err)
+	}
+
+	// only the wait for the other peer is bounded, not the transfer itself
+	waitCtx, cancelWait := context.WithTimeout(ctx, opts.PeerTimeout)
+	defer cancelWait()
+	if _, err := s.ws.WaitForAnswer(waitCtx); err != nil {
+		return fmt.Errorf("no collector connected: %w", err)
+	}
+
+	return s.wait(ctx)
+}
+
+// Receive collects the file offered with code and writes it to sink
+func Receive(ctx context.Context, code string, sink Sink, opts Options) error {
+	opts = opts.withDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s, err := newSession(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	rcv := newReceiver(sink, opts.Logger, s.finish)
+	rcv.onFile, rcv.progress, rcv.onVerified = opts.OnFile, opts.OnProgress, opts.OnVerified
+	var channel atomic.Pointer[webrtc.DataChannel]
+	s.rtc.OnDataChannel(func(d *webrtc.DataChannel) {
+		channel.Store(d)
+		d.OnOpen(func() {
+			if opts.OnConnected != nil {
+				opts.OnConnected()
+			}
+		})
+		d.OnMessage(func(msg webrtc.DataChannelMessage) {
+			rcv.HandleFileReception(d, msg)
+		})
+	})
+
+	s.ws.SetPhrase(code)
+	if err := s.ws.GetOffer(); err != nil {
+		return fmt.Errorf("unable to get offer from sender: %w", err)
+	}
+
+	waitCtx, cancelWait := context.WithTimeout(ctx, opts.PeerTimeout)
+	defer cancelWait()
+	if _, err := s.ws.WaitForOffer(waitCtx); err != nil {
+		return fmt.Errorf("unable to collect from sender: %w", err)
+	}
+
+	answerSDP, err := s.rtc.CreateAnswer()
+	if err != nil {
+		return fmt.Errorf("%w: unable to create answer: %w", ErrPeerConnectionFailed, err)
+	}
+	if err := s.ws.SendWebrtcSessionDescription(answerSDP); err != nil {
+		return fmt.Errorf("unable to send answer: %w", err)
+	}
+
+	err = s.wait(ctx)
+	// the result sent to the sender is lost if the connection closes first
+	if d := channel.Load(); d != nil {
+		drain(d, resultTimeout)
+	}
+	return err
+}
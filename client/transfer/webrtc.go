@@ -0,0 +1,192 @@
+package transfer
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type peerConnection struct {
+	*webrtc.PeerConnection
+	log *slog.Logger
+	// remote candidates can arrive from the relay before the remote
+	// description is set, they are held here until it has been
+	candidateMu       sync.Mutex
+	remoteSet         bool
+	pendingCandidates []webrtc.ICECandidateInit
+}
+
+// newPeerConnection creates the peer connection gathering candidates with
+// the given ICE servers, only host candidates are gathered without any
+func newPeerConnection(iceServers []webrtc.ICEServer, includeLoopback bool, log *slog.Logger) (*peerConnection, error) {
+	config := webrtc.Configuration{
+		ICETransportPolicy: webrtc.ICETransportPolicyAll,
+		ICEServers:         iceServers,
+	}
+	var settings webrtc.SettingEngine
+	settings.SetIncludeLoopbackCandidate(includeLoopback)
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(settings)).NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	return &peerConnection{PeerConnection: pc, log: log}, nil
+}
+
+func (c *peerConnection) CreateOffer() (*webrtc.SessionDescription, error) {
+	offer, err := c.PeerConnection.CreateOffer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.PeerConnection.SetLocalDescription(offer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &offer, nil
+}
+
+// SetRemoteDescription sets the remote description and then adds any
+// candidates which were received before it
+func (c *peerConnection) SetRemoteDescription(sdp webrtc.SessionDescription) error {
+	c.candidateMu.Lock()
+	defer c.candidateMu.Unlock()
+
+	// a resumed session replays the answer, which may have arrived already
+	if c.remoteSet {
+		if current := c.PeerConnection.RemoteDescription(); current != nil && current.SDP == sdp.SDP {
+			return nil
+		}
+	}
+
+	if err := c.PeerConnection.SetRemoteDescription(sdp); err != nil {
+		return err
+	}
+	c.remoteSet = true
+
+	for _, candidate := range c.pendingCandidates {
+		if err := c.PeerConnection.AddICECandidate(candidate); err != nil {
+			c.log.Error("unable to add queued ice candidate", "error", err.Error())
+		}
+	}
+	c.pendingCandidates = nil
+	return nil
+}
+
+// AddICECandidate adds the remote candidate, or queues it if the remote
+// description has not been set yet
+func (c *peerConnection) AddICECandidate(candidate webrtc.ICECandidateInit) error {
+	c.candidateMu.Lock()
+	defer c.candidateMu.Unlock()
+
+	if !c.remoteSet {
+		c.pendingCandidates = append(c.pendingCandidates, candidate)
+		return nil
+	}
+	return c.PeerConnection.AddICECandidate(candidate)
+}
+
+func (c *peerConnection) CreateAnswer() (*webrtc.SessionDescription, error) {
+	answer, err := c.PeerConnection.CreateAnswer(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.PeerConnection.SetLocalDescription(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &answer, nil
+}
+
+// HandleChanges logs the state of the connection, closing the signaling
+// connection once the peers are connected and calling fail if they cannot
+// connect or lose the connection
+func (c *peerConnection) HandleChanges(ws *socket, fail func(error)) {
+	// Log ICE connection state changes
+	c.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		c.log.Info("ICE Connection State has changed", "state", state.String())
+	})
+
+	// Log signaling state changes
+	c.OnSignalingStateChange(func(state webrtc.SignalingState) {
+		c.log.Info("Signaling State has changed", "state", state.String())
+	})
+
+	// Log connection state changes
+	c.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		c.log.Info("PeerConnection State has changed", "state", state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			//cleanup websocket connection
+			ws.CloseNormal()
+		}
+		if state == webrtc.PeerConnectionStateFailed {
+			fail(ErrPeerConnectionFailed)
+		}
+	})
+
+	// Log ICE candidate gathering state changes
+	c.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
+		c.log.Info("ICE Gathering State has changed", "state", state.String())
+	})
+}
+
+// maxBufferedAmount bounds the bytes queued on a data channel, so progress
+// follows what the network has taken and large files are not read into
+// memory faster than they are sent
+const maxBufferedAmount = 1 << 20
+
+// flowControl blocks sends while the data channel has too much queued
+type flowControl struct {
+	*webrtc.DataChannel
+	low       chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFlowControl(dc *webrtc.DataChannel) *flowControl {
+	f := &flowControl{DataChannel: dc, low: make(chan struct{}, 1), closed: make(chan struct{})}
+	dc.SetBufferedAmountLowThreshold(maxBufferedAmount / 2)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case f.low <- struct{}{}:
+		default:
+		}
+	})
+	return f
+}
+
+// Send waits for the queue to drain below the threshold when it is full
+func (f *flowControl) Send(data []byte) error {
+	for f.BufferedAmount() > maxBufferedAmount {
+		select {
+		case <-f.low:
+		case <-f.closed:
+			return fmt.Errorf("%w: the data channel closed", ErrTransferAborted)
+		}
+	}
+	return f.DataChannel.Send(data)
+}
+
+// resultTimeout bounds the wait for the collector's result to reach the
+// sender before the connection is closed
+const resultTimeout = 5 * time.Second
+
+// drain waits until the other peer has acknowledged everything queued on
+// the data channel, the channel closes or timeout passes
+func drain(d *webrtc.DataChannel, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for d.BufferedAmount() > 0 && d.ReadyState() == webrtc.DataChannelStateOpen && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// close stops sends waiting for the queue to drain, it must be called once
+// the data channel has closed
+func (f *flowControl) close() {
+	f.closeOnce.Do(func() { close(f.closed) })
+}
@@ -0,0 +1,601 @@
+package transfer
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"encoding/base64"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+)
+
+// socket is the connection to the relay server used for signaling
+type socket struct {
+	*websocket.Conn
+	*connectionItems
+	// writeMu is held while writing and while the connection is replaced
+	// after reconnecting
+	writeMu sync.Mutex
+	// url and auth are kept to reconnect to the relay
+	url  url.URL
+	auth RelayAuth
+	log  *slog.Logger
+	// onCode is called when the relay issues a phrase to the sender
+	onCode func(string)
+}
+
+// connectionItems holds the signaling state shared between the goroutine
+// reading from the relay and the goroutine establishing the connection.
+type connectionItems struct {
+	mu     sync.Mutex
+	phrase string
+	// local candidates gathered before the relay has issued a phrase, sent
+	// once SetPhrase is called
+	pendingCandidates []*webrtc.ICECandidate
+	// offerSDP and answerSDP receive the remote session description once it
+	// has been applied to the peer connection
+	offerSDP  chan webrtc.SessionDescription
+	answerSDP chan webrtc.SessionDescription
+	// errs receives any error which ends signaling with the relay
+	errs chan error
+	// capabilities agreed with the relay during the handshake
+	capabilities []string
+	// resumeToken is issued with the phrase and lets a sender reclaim its
+	// session after losing its connection to the relay
+	resumeToken string
+	// resuming is set while a resumed session waits for the relay to confirm
+	resuming bool
+	// finished is set once signaling is complete, the connection is not
+	// restored if it drops after that
+	finished bool
+	// signalingDone is closed along with setting finished, stopping the
+	// keepalive as the relay has been sent a close frame
+	signalingDone chan struct{}
+}
+
+var sdpTypes = map[string]webrtc.SDPType{
+	protocol.TypeAnswer: webrtc.SDPTypeAnswer,
+	protocol.TypeOffer:  webrtc.SDPTypeOffer,
+}
+
+// RelayAuth holds the credentials presented to the relay server
+type RelayAuth struct {
+	// Token is sent as a bearer token when set
+	Token string
+	// Certificates are presented when the relay asks for a client certificate
+	Certificates []tls.Certificate
+}
+
+const (
+	// writeTimeout bounds each write to the relay so a dead connection
+	// cannot block writers
+	writeTimeout = 10 * time.Second
+	// reconnectTimeout is how long a sender keeps trying to reach the relay
+	// after losing its connection
+	reconnectTimeout = time.Minute
+	// the delay between reconnection attempts doubles from
+	// initialReconnectDelay up to maxReconnectDelay
+	initialReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay     = 8 * time.Second
+)
+
+// connectRelay connects to the relay and performs the handshake
+func connectRelay(url url.URL, auth RelayAuth, log *slog.Logger) (*socket, error) {
+	conn, err := dial(url, auth)
+	if errors.Is(err, websocket.ErrBadHandshake) {
+		// the server answered, its health check tells whether it is the relay
+		return nil, fmt.Errorf("%w, %s", err, probeHealth(url, auth))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &socket{
+		Conn: conn,
+		connectionItems: &connectionItems{
+			offerSDP:  make(chan webrtc.SessionDescription, 1),
+			answerSDP: make(chan webrtc.SessionDescription, 1),
+			errs:      make(chan error, 1),
+
+			signalingDone: make(chan struct{}),
+		},
+		url:  url,
+		auth: auth,
+		log:  log,
+	}
+
+	if err := s.ping(); err != nil {
+		conn.Close()
+		var relayErr *protocol.Error
+		if errors.As(err, &relayErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w at %s: %w", ErrRelayUnreachable, url.String(), err)
+	}
+
+	return s, nil
+}
+
+func dial(url url.URL, auth RelayAuth) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = &tls.Config{Certificates: auth.Certificates}
+
+	header := http.Header{}
+	if auth.Token != "" {
+		header.Set("Authorization", "Bearer "+auth.Token)
+	}
+
+	conn, resp, err := dialer.Dial(url.String(), header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, &protocol.Error{
+				Code:    protocol.CodeUnauthorized,
+				Message: fmt.Sprintf("relay server at %s refused the connection: %s", url.String(), resp.Status),
+			}
+		}
+		return nil, fmt.Errorf("%w at %s: %w", ErrRelayUnreachable, url.String(), describeDialError(url, err, resp))
+	}
+	return conn, nil
+}
+
+// ping performs the handshake with the relay, advertising the protocol
+// version and capabilities of this build
+func (s *socket) ping() error {
+	msg := &protocol.Message{
+		MessageType: protocol.TypePing,
+		Content:     protocol.NewHello(),
+	}
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	err = s.writeMessage(websocket.TextMessage, jsonBytes)
+	if err != nil {
+		return err
+	}
+
+	_, receivedMessage, err := s.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("error reading message %v", err.Error())
+	}
+
+	response := &protocol.Message{}
+	err = json.Unmarshal(receivedMessage, &response)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling response %v", err.Error())
+	}
+
+	if response.MessageType == protocol.TypeError {
+		return fmt.Errorf("relay server rejected the connection: %w", response.ToError())
+	}
+	if response.MessageType != protocol.TypePong {
+		return errors.New("received message but was not pong")
+	}
+
+	var hello protocol.Hello
+	if err := response.DecodeContent(&hello); err != nil {
+		return fmt.Errorf("error reading handshake from relay server %v", err.Error())
+	}
+	if hello.Version < protocol.Version {
+		return &protocol.Error{
+			Code:    protocol.CodeUnsupportedVersion,
+			Message: fmt.Sprintf("relay server speaks protocol version %d but this client requires version %d", hello.Version, protocol.Version),
+		}
+	}
+	s.capabilities = protocol.Negotiate(protocol.Capabilities, hello.Capabilities)
+	s.log.Info("handshake with relay complete", "version", hello.Version, "capabilities", s.capabilities)
+
+	return nil
+}
+
+// keepAlive pings the relay until ctx is done or signaling is complete
+func (s *socket) keepAlive(ctx context.Context) {
+	msg := &protocol.Message{
+		MessageType: protocol.TypePing,
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.signalingDone:
+			return
+		case <-ticker.C:
+			if err := s.marshalAndSend(msg); err != nil {
+				s.log.Error("error sending keepalive message to websocket server")
+			} else {
+				s.log.Info("successfully sent keepalive to websocket server")
+			}
+		}
+	}
+}
+
+// setResumeToken records the resume token from a phrase create message,
+// reporting whether it confirms a resumed session rather than a new one
+func (s *socket) setResumeToken(msg *protocol.Message) bool {
+	var created protocol.PhraseCreated
+	if slices.Contains(s.capabilities, protocol.CapResume) {
+		if err := msg.DecodeContent(&created); err != nil {
+			s.log.Error("unable to read resume token", "error", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if created.ResumeToken != "" {
+		s.resumeToken = created.ResumeToken
+	}
+	resumed := s.resuming
+	s.resuming = false
+	return resumed
+}
+
+// Phrase returns the phrase identifying the session on the relay
+func (s *socket) Phrase() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.phrase
+}
+
+func (s *socket) SetPhrase(phrase string) {
+	s.mu.Lock()
+	s.phrase = phrase
+	pending := s.pendingCandidates
+	s.pendingCandidates = nil
+	s.mu.Unlock()
+
+	for _, candidate := range pending {
+		if err := s.SendIceCandidate(candidate); err != nil {
+			s.log.Error("unable to send queued ice candidate", "error", err.Error())
+		}
+	}
+}
+
+// WaitForOffer blocks until the sender's offer has been applied to the peer
+// connection, the relay reports an error or the context is done.
+func (s *socket) WaitForOffer(ctx context.Context) (webrtc.SessionDescription, error) {
+	return s.waitForSessionDescription(ctx, s.offerSDP)
+}
+
+// WaitForAnswer blocks until the collector's answer has been applied to the
+// peer connection, the relay reports an error or the context is done.
+func (s *socket) WaitForAnswer(ctx context.Context) (webrtc.SessionDescription, error) {
+	return s.waitForSessionDescription(ctx, s.answerSDP)
+}
+
+func (s *socket) waitForSessionDescription(ctx context.Context, sdpChan <-chan webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	select {
+	case sdp := <-sdpChan:
+		return sdp, nil
+	case err := <-s.errs:
+		return webrtc.SessionDescription{}, err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return webrtc.SessionDescription{}, ErrPeerTimeout
+		}
+		return webrtc.SessionDescription{}, ctx.Err()
+	}
+}
+
+// CloseNormal tells the relay that signaling is complete
+func (s *socket) CloseNormal() error {
+	s.mu.Lock()
+	if !s.finished {
+		s.finished = true
+		close(s.signalingDone)
+	}
+	s.mu.Unlock()
+	return s.writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// writeMessage serialises writes, the websocket connection supports only one
+// concurrent writer
+func (s *socket) writeMessage(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := s.WriteMessage(messageType, data); err != nil {
+		return fmt.Errorf("%w: %w", ErrRelayUnreachable, err)
+	}
+	return nil
+}
+
+// closeConn closes the current connection to the relay
+func (s *socket) closeConn() {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.Close()
+}
+
+// replaceConn swaps in a new connection to the relay, closing the old one
+func (s *socket) replaceConn(conn *websocket.Conn) {
+	s.writeMu.Lock()
+	old := s.Conn
+	s.Conn = conn
+	s.writeMu.Unlock()
+	old.Close()
+}
+
+// canResume reports whether a lost connection should be restored, which is
+// the case for a sender holding a resume token until signaling is complete
+func (s *socket) canResume(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumeToken != "" && !s.finished && !websocket.IsCloseError(err, websocket.CloseNormalClosure)
+}
+
+// reconnect restores a lost connection to the relay and asks it to resume
+// the session, backing off exponentially between attempts. Candidates
+// gathered in the meantime are queued until the relay confirms the phrase.
+func (s *socket) reconnect(ctx context.Context) error {
+	s.mu.Lock()
+	phrase, token := s.phrase, s.resumeToken
+	s.phrase = ""
+	s.resuming = true
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(reconnectTimeout)
+	delay := initialReconnectDelay
+	for {
+		err := s.resumeSession(phrase, token)
+		if err == nil {
+			return nil
+		}
+		var relayErr *protocol.Error
+		if errors.As(err, &relayErr) && !relayErr.Retryable {
+			return err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		s.log.Info("unable to reconnect to relay server, retrying", "in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// resumeSession makes one attempt to reconnect and resume, the relay's reply
+// is handled by HandleIncomingMessages
+func (s *socket) resumeSession(phrase, token string) error {
+	conn, err := dial(s.url, s.auth)
+	if err != nil {
+		return err
+	}
+	s.replaceConn(conn)
+	if err := s.ping(); err != nil {
+		return err
+	}
+	return s.marshalAndSend(&protocol.Message{
+		MessageType: protocol.TypeResume,
+		Phrase:      phrase,
+		Content:     token,
+	})
+}
+
+// signalError records the first error which ends signaling, later errors are
+// only logged
+func (s *socket) signalError(err error) {
+	select {
+	case s.errs <- err:
+	default:
+		s.log.Error("signaling error", "error", err.Error())
+	}
+}
+
+func (s *socket) SendWebrtcSessionDescription(sdp *webrtc.SessionDescription) error {
+	msg := &protocol.Message{
+		MessageType: sdp.Type.String(),
+		Phrase:      s.Phrase(),
+		Content:     sdp.SDP,
+	}
+	return s.marshalAndSend(msg)
+}
+
+// SendOffer sends the sender's offer, requesting a specific phrase or a
+// phrase with a number of words when either is set
+func (s *socket) SendOffer(sdp *webrtc.SessionDescription, phrase string, words int) error {
+	if phrase == "" && words == 0 {
+		return s.SendWebrtcSessionDescription(sdp)
+	}
+	if !slices.Contains(s.capabilities, protocol.CapCustomPhrase) {
+		return ErrCustomCodeUnsupported
+	}
+	return s.marshalAndSend(&protocol.Message{
+		MessageType: protocol.TypeOffer,
+		Content:     &protocol.Offer{SDP: sdp.SDP, Phrase: phrase, Words: words},
+	})
+}
+
+// SendIceCandidate relays a local candidate to the other peer. Candidates
+// gathered before the relay has issued a phrase are queued until it has.
+func (s *socket) SendIceCandidate(ic *webrtc.ICECandidate) error {
+	s.mu.Lock()
+	phrase := s.phrase
+	if phrase == "" {
+		s.pendingCandidates = append(s.pendingCandidates, ic)
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	candidateJson := ic.ToJSON()
+	candidateStr, err := json.Marshal(candidateJson)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(candidateStr))
+	msg := &protocol.Message{
+		MessageType: protocol.TypeICECandidate,
+		Phrase:      phrase,
+		Content:     encoded,
+	}
+	return s.marshalAndSend(msg)
+}
+
+func (s *socket) marshalAndSend(msg *protocol.Message) error {
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.writeMessage(websocket.TextMessage, jsonBytes)
+}
+
+func (s *socket) GetOffer() error {
+	message := &protocol.Message{
+		MessageType: protocol.TypeGetOffer,
+		Phrase:      s.Phrase(),
+	}
+	return s.marshalAndSend(message)
+}
+
+// HandleIncomingMessages reads from the relay until the connection is closed
+// or the context is done. Session descriptions and errors are passed back to
+// the waiting goroutine over the connectionItems channels.
+func (s *socket) HandleIncomingMessages(ctx context.Context, peerConn *peerConnection) {
+	// unblock ReadMessage when the context is cancelled
+	stop := context.AfterFunc(ctx, s.closeConn)
+	defer stop()
+
+	for {
+		_, receivedMessage, err := s.ReadMessage()
+		if err != nil {
+			if ctx.Err() == nil && s.canResume(err) {
+				s.log.Info("lost connection to relay server, reconnecting", "error", err)
+				if err := s.reconnect(ctx); err != nil {
+					s.signalError(fmt.Errorf("%w, lost connection: %w", ErrRelayUnreachable, err))
+					return
+				}
+				continue
+			}
+			if websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				s.signalError(&protocol.Error{
+					Code:      protocol.CodeServerDraining,
+					Message:   "relay server is shutting down",
+					Retryable: true,
+				})
+				return
+			}
+			if ctx.Err() == nil && websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+				s.signalError(fmt.Errorf("%w, lost connection: %w", ErrRelayUnreachable, err))
+			}
+			return
+		}
+		msg := &protocol.Message{}
+		err = json.Unmarshal(receivedMessage, &msg)
+		if err != nil {
+			s.log.Error("Error unmarshalling message", "error", err.Error())
+			continue
+		}
+
+		switch msg.MessageType {
+		case protocol.TypePhraseCreate:
+			resumed := s.setResumeToken(msg)
+			s.SetPhrase(msg.Phrase)
+			if resumed {
+				s.log.Info("resumed session with relay server", "phrase", msg.Phrase)
+				continue
+			}
+			// the sender passes the phrase on to the collector
+			if s.onCode != nil {
+				s.onCode(msg.Phrase)
+			}
+		case protocol.TypeAnswer, protocol.TypeOffer:
+			sdp, err := toSessionDescription(msg)
+			if err != nil {
+				s.signalError(err)
+				continue
+			}
+			if err := peerConn.SetRemoteDescription(*sdp); err != nil {
+				s.signalError(fmt.Errorf("%w: unable to set remote description: %w", ErrPeerConnectionFailed, err))
+				continue
+			}
+			sdpChan := s.answerSDP
+			if sdp.Type == webrtc.SDPTypeOffer {
+				sdpChan = s.offerSDP
+			}
+			select {
+			case sdpChan <- *sdp:
+			default:
+				s.log.Info("ignoring duplicate session description", "type", sdp.Type.String())
+			}
+		case protocol.TypeICECandidate:
+			candidate, err := toIceCandidate(msg)
+			if err != nil {
+				s.log.Error("error getting ice candidate", "error", err)
+				continue
+			}
+			if err := peerConn.AddICECandidate(*candidate); err != nil {
+				s.log.Error("unable to add ice candidate", "error", err.Error())
+			}
+		case protocol.TypeError:
+			s.signalError(msg.ToError())
+		case protocol.TypePeerDisconnected:
+			s.log.Info("peer disconnected from relay", "role", msg.Content)
+			s.signalError(ErrPeerDisconnected)
+		case protocol.TypePong:
+			s.log.Info("keepalive successful")
+		}
+	}
+}
+
+// toSessionDescription reads an offer or answer, the SDP itself is checked
+// when it is set on the peer connection
+func toSessionDescription(m *protocol.Message) (*webrtc.SessionDescription, error) {
+	sdpType, ok := sdpTypes[m.MessageType]
+	if !ok {
+		return nil, fmt.Errorf("message type %q is not a session description", m.MessageType)
+	}
+	sdpString, ok := m.Content.(string)
+	if !ok {
+		return nil, errors.New("error reading the sdp string from response")
+	}
+	if sdpString == "" {
+		return nil, errors.New("the session description is empty")
+	}
+
+	return &webrtc.SessionDescription{
+		Type: sdpType,
+		SDP:  sdpString,
+	}, nil
+}
+
+func toIceCandidate(m *protocol.Message) (*webrtc.ICECandidateInit, error) {
+	iceString, ok := m.Content.(string)
+	if !ok {
+		return nil, errors.New("error reading the candidate string from response")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(iceString)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidate webrtc.ICECandidateInit
+
+	err = json.Unmarshal([]byte(decoded), &candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &candidate, nil
+}
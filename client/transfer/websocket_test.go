@@ -0,0 +1,180 @@
+package transfer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRelay issues a phrase with a resume token on the first connection then
+// drops it, later connections accept the resume and pass it to resumed
+func fakeRelay(t *testing.T, resumed chan<- *protocol.Message) *url.URL {
+	var connections atomic.Int32
+	upgrader := websocket.Upgrader{}
+	phraseCreate := &protocol.Message{
+		MessageType: protocol.TypePhraseCreate,
+		Phrase:      "apple.banana",
+		Content:     &protocol.PhraseCreated{Phrase: "apple.banana", ResumeToken: "token"},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		first := connections.Add(1) == 1
+
+		msg := &protocol.Message{}
+		if err := conn.ReadJSON(msg); err != nil {
+			return
+		}
+		conn.WriteJSON(&protocol.Message{MessageType: protocol.TypePong, Content: protocol.NewHello()})
+
+		if first {
+			if err := conn.ReadJSON(msg); err != nil {
+				return
+			}
+			// closing without a close frame looks like a dropped connection
+			conn.WriteJSON(phraseCreate)
+			return
+		}
+
+		for {
+			if err := conn.ReadJSON(msg); err != nil {
+				return
+			}
+			if msg.MessageType == protocol.TypeResume {
+				resumed <- msg
+				conn.WriteJSON(phraseCreate)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	require.NoError(t, err)
+	return u
+}
+
+func TestSenderResumesAfterLosingConnection(t *testing.T) {
+	resumed := make(chan *protocol.Message, 1)
+	u := fakeRelay(t, resumed)
+
+	ws, err := connectRelay(*u, RelayAuth{}, slog.Default())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go ws.HandleIncomingMessages(ctx, nil)
+
+	require.NoError(t, ws.SendWebrtcSessionDescription(&webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "offer"}))
+
+	select {
+	case msg := <-resumed:
+		assert.Equal(t, "apple.banana", msg.Phrase)
+		assert.Equal(t, "token", msg.Content)
+	case err := <-ws.errs:
+		t.Fatalf("signaling failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("sender did not resume its session")
+	}
+
+	assert.Eventually(t, func() bool {
+		return ws.Phrase() == "apple.banana"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNoResumeAfterSignalingFinished(t *testing.T) {
+	s := &socket{connectionItems: &connectionItems{resumeToken: "token"}}
+	dropped := &websocket.CloseError{Code: websocket.CloseAbnormalClosure}
+	assert.True(t, s.canResume(dropped))
+	assert.False(t, s.canResume(&websocket.CloseError{Code: websocket.CloseNormalClosure}))
+
+	s.finished = true
+	assert.False(t, s.canResume(dropped))
+}
+
+func TestKeepAliveStopsOnceSignalingFinished(t *testing.T) {
+	ws, err := connectRelay(*fakeRelay(t, nil), RelayAuth{}, slog.Default())
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.closeConn() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stopped := make(chan struct{})
+	go func() {
+		ws.keepAlive(ctx)
+		close(stopped)
+	}()
+	ws.CloseNormal()
+	ws.CloseNormal()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("keepalive kept pinging the relay after the close frame was sent")
+	}
+}
+
+func TestSendOfferRequiresCustomPhraseCapability(t *testing.T) {
+	s := &socket{connectionItems: &connectionItems{}}
+	offer := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "offer"}
+	assert.ErrorIs(t, s.SendOffer(offer, "acme-invoices-2024", 0), ErrCustomCodeUnsupported)
+	assert.ErrorIs(t, s.SendOffer(offer, "", 4), ErrCustomCodeUnsupported)
+}
+
+func FuzzToSessionDescription(f *testing.F) {
+	f.Add([]byte(`{"messagetype":"offer","content":"v=0\r\n"}`))
+	f.Add([]byte(`{"messagetype":"answer","content":""}`))
+	f.Add([]byte(`{"messagetype":"ice candidate","content":"v=0\r\n"}`))
+	f.Add([]byte(`{"messagetype":"offer","content":{"sdp":1}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m protocol.Message
+		if json.Unmarshal(data, &m) != nil {
+			return
+		}
+		sdp, err := toSessionDescription(&m)
+		if err != nil {
+			return
+		}
+		if sdp.SDP == "" || (sdp.Type != webrtc.SDPTypeOffer && sdp.Type != webrtc.SDPTypeAnswer) {
+			t.Fatalf("accepted %+v from a %q message", sdp, m.MessageType)
+		}
+	})
+}
+
+func FuzzToIceCandidate(f *testing.F) {
+	candidate, err := json.Marshal(webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host"})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add([]byte(`{"messagetype":"ice candidate","content":"` + base64.StdEncoding.EncodeToString(candidate) + `"}`))
+	f.Add([]byte(`{"messagetype":"ice candidate","content":"junk"}`))
+	f.Add([]byte(`{"messagetype":"ice candidate","content":"` + base64.StdEncoding.EncodeToString([]byte("null")) + `"}`))
+	f.Add([]byte(`{"messagetype":"ice candidate","content":7}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m protocol.Message
+		if json.Unmarshal(data, &m) != nil {
+			return
+		}
+		if c, err := toIceCandidate(&m); err == nil && c == nil {
+			t.Fatal("no candidate and no error")
+		}
+	})
+}
@@ -0,0 +1,3 @@
+module github.com/Ryan-Har/adit/protocol
+
+go 1.22.3
@@ -0,0 +1,181 @@
+// Package protocol defines the signaling messages exchanged between the adit
+// client and the relay server. Both sides import it so that the wire format
+// cannot drift between them.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+const (
+	// Version is the signaling protocol version spoken by this build
+	Version = 1
+	// MinVersion is the oldest protocol version the relay still accepts
+	MinVersion = 1
+)
+
+// Message types sent in Message.MessageType
+const (
+	TypePing         = "ping"
+	TypePong         = "pong"
+	TypeOffer        = "offer"
+	TypeAnswer       = "answer"
+	TypeGetOffer     = "get offer"
+	TypePhraseCreate = "phrase create"
+	TypeICECandidate = "ice candidate"
+	TypeError        = "error"
+	// TypeResume is sent by a sender which lost its connection to reclaim its
+	// session, Content is the resume token from PhraseCreated
+	TypeResume = "resume"
+	// TypePeerDisconnected is sent by the relay when the other peer in a
+	// session loses its connection, Content is the role of that peer
+	TypePeerDisconnected = "peer disconnected"
+)
+
+// Capabilities which may be advertised during the handshake
+const (
+	// CapTrickleICE means candidates sent before the other peer joins are
+	// queued by the relay and replayed to it
+	CapTrickleICE = "trickle-ice"
+	// CapResume means the phrase create message carries PhraseCreated with a
+	// resume token, and a sender may reconnect with TypeResume
+	CapResume = "resume"
+	// CapCustomPhrase means an offer may carry Offer to choose the phrase or
+	// its number of words
+	CapCustomPhrase = "custom-phrase"
+)
+
+// Capabilities lists everything supported by this build
+var Capabilities = []string{CapTrickleICE, CapResume, CapCustomPhrase}
+
+type Message struct {
+	MessageType string `json:"messagetype"`
+	Phrase      string `json:"phrase"`
+	Content     any    `json:"content"`
+}
+
+// Hello is the content of the first ping sent by a client and of the pong
+// the relay sends in reply
+type Hello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// NewHello returns the Hello describing this build
+func NewHello() *Hello {
+	return &Hello{
+		Version:      Version,
+		Capabilities: slices.Clone(Capabilities),
+	}
+}
+
+// Supports reports whether the capability was advertised
+func (h *Hello) Supports(capability string) bool {
+	return slices.Contains(h.Capabilities, capability)
+}
+
+// Negotiate returns the capabilities present in both lists
+func Negotiate(local, remote []string) []string {
+	var common []string
+	for _, c := range local {
+		if slices.Contains(remote, c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+// Offer is the content of an offer message when the sender chooses its
+// phrase, otherwise the content is the SDP alone
+type Offer struct {
+	SDP string `json:"sdp"`
+	// Phrase requests a specific phrase, which the relay rejects if it is
+	// too easy to guess or already in use
+	Phrase string `json:"phrase,omitempty"`
+	// Words requests a generated phrase with this many words
+	Words int `json:"words,omitempty"`
+}
+
+// PhraseCreated is the content of a phrase create message when CapResume
+// has been negotiated
+type PhraseCreated struct {
+	Phrase string `json:"phrase"`
+	// ResumeToken lets the sender reclaim the session if its connection to
+	// the relay drops, it is empty when the relay does not allow resuming
+	ResumeToken string `json:"resumeToken,omitempty"`
+}
+
+// DecodeContent decodes a structured Content into v. Content is unmarshalled
+// into generic maps and slices, so it is round tripped through JSON.
+func (m *Message) DecodeContent(v any) error {
+	b, err := json.Marshal(m.Content)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Error codes sent in Error.Code
+const (
+	CodeMalformedMessage   = "malformed_message"
+	CodeUnknownMessageType = "unknown_message_type"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeHandshakeRequired  = "handshake_required"
+	CodePhraseNotFound     = "phrase_not_found"
+	CodePhraseClaimed      = "phrase_claimed"
+	CodeNotSessionMember   = "not_session_member"
+	CodeMalformedSDP       = "malformed_sdp"
+	CodeMalformedCandidate = "malformed_candidate"
+	CodePhraseRejected     = "phrase_rejected"
+	CodePhraseInUse        = "phrase_in_use"
+	CodeLimitExceeded      = "limit_exceeded"
+	CodeRateLimited        = "rate_limited"
+	CodeSessionInvalidated = "session_invalidated"
+	CodeSessionExpired     = "session_expired"
+	CodeUnauthorized       = "unauthorized"
+	CodeServerDraining     = "server_draining"
+	CodeInternal           = "internal"
+)
+
+// Error is the content of a message of TypeError
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Retryable is true when the same request may succeed if sent again later
+	Retryable bool `json:"retryable"`
+	// Suggestion is a phrase the collector may have meant when the one it
+	// looked up does not exist
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewError returns an error message ready to be sent
+func NewError(code, message string, retryable bool) *Message {
+	return &Message{
+		MessageType: TypeError,
+		Content: &Error{
+			Code:      code,
+			Message:   message,
+			Retryable: retryable,
+		},
+	}
+}
+
+// ToError decodes the content of an error message. Errors without a code,
+// such as those from relays older than this schema, are reported as
+// CodeInternal with the content as the message.
+func (m *Message) ToError() *Error {
+	var e Error
+	if err := m.DecodeContent(&e); err != nil || e.Code == "" {
+		return &Error{
+			Code:    CodeInternal,
+			Message: fmt.Sprint(m.Content),
+		}
+	}
+	return &e
+}
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeContentHello(t *testing.T) {
+	b, err := json.Marshal(&Message{MessageType: TypePing, Content: NewHello()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var hello Hello
+	if err := msg.DecodeContent(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&hello, NewHello()) {
+		t.Errorf("decoded %+v, want %+v", hello, NewHello())
+	}
+}
+
+func TestDecodeContentMissing(t *testing.T) {
+	msg := &Message{MessageType: TypePing}
+
+	var hello Hello
+	if err := msg.DecodeContent(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != 0 {
+		t.Errorf("expected no version from an old client, got %d", hello.Version)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	common := Negotiate([]string{"a", "b", "c"}, []string{"c", "a", "d"})
+	if !reflect.DeepEqual(common, []string{"a", "c"}) {
+		t.Errorf("unexpected capabilities %v", common)
+	}
+	if common := Negotiate([]string{"a"}, nil); common != nil {
+		t.Errorf("expected no capabilities, got %v", common)
+	}
+}
+
+func TestToError(t *testing.T) {
+	b, err := json.Marshal(NewError(CodePhraseNotFound, "phrase does not exist", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &Message{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Error{Code: CodePhraseNotFound, Message: "phrase does not exist"}
+	if got := msg.ToError(); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestToErrorWithoutCode(t *testing.T) {
+	msg := &Message{MessageType: TypeError, Content: "upgrade required"}
+
+	got := msg.ToError()
+	if got.Code != CodeInternal || got.Message != "upgrade required" {
+		t.Errorf("unexpected error %+v", got)
+	}
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	_ "embed"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// PhraseSeparator joins the nameplate and words of a generated phrase, such
+// as 7-chosen-murmuring
+const PhraseSeparator = "-"
+
+//go:embed wordlist.json
+var wordlistFile []byte
+
+// Wordlist returns the sorted words generated phrases are made from. Words
+// containing a separator are left out so every word of a phrase can be
+// completed and corrected on its own. The slice is shared and must not be
+// modified.
+var Wordlist = sync.OnceValue(func() []string {
+	var words []string
+	if err := json.Unmarshal(wordlistFile, &words); err != nil {
+		panic("protocol: unable to parse the embedded wordlist: " + err.Error())
+	}
+	words = slices.DeleteFunc(words, func(w string) bool {
+		return strings.IndexFunc(w, IsPhraseSeparator) != -1
+	})
+	slices.Sort(words)
+	return words
+})
+
+// IsWord reports whether word is in the wordlist
+func IsWord(word string) bool {
+	_, found := slices.BinarySearch(Wordlist(), word)
+	return found
+}
+
+// WordsWithPrefix returns the words in the wordlist starting with prefix
+func WordsWithPrefix(prefix string) []string {
+	words := Wordlist()
+	start, _ := slices.BinarySearch(words, prefix)
+	end := start
+	for end < len(words) && strings.HasPrefix(words[end], prefix) {
+		end++
+	}
+	return words[start:end]
+}
+
+// IsPhraseSeparator reports whether r may separate the parts of a phrase
+func IsPhraseSeparator(r rune) bool {
+	return r == '-' || r == '.' || r == '_'
+}
+
+// NormalisePhrase lets a phrase be typed in any case and with spaces between
+// its parts
+func NormalisePhrase(phrase string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(phrase), unicode.IsSpace), PhraseSeparator)
+}
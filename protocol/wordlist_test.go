@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWordlist(t *testing.T) {
+	words := Wordlist()
+	if len(words) < 7000 {
+		t.Fatalf("wordlist has %d words", len(words))
+	}
+	if IsWord("t-shirt") {
+		t.Error("words containing a separator should be left out")
+	}
+	if !IsWord("murmuring") {
+		t.Error("murmuring should be in the wordlist")
+	}
+}
+
+func TestWordsWithPrefix(t *testing.T) {
+	if got, want := WordsWithPrefix("murmur"), []string{"murmuring"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WordsWithPrefix(murmur) = %v, want %v", got, want)
+	}
+	if got := WordsWithPrefix("zzz"); len(got) != 0 {
+		t.Errorf("WordsWithPrefix(zzz) = %v, want none", got)
+	}
+}
+
+func TestNormalisePhrase(t *testing.T) {
+	tests := map[string]string{
+		"7-chosen-murmuring":         "7-chosen-murmuring",
+		" 7 Chosen  Murmuring\n":     "7-chosen-murmuring",
+		"chosen.murmuring.germproof": "chosen.murmuring.germproof",
+	}
+	for in, want := range tests {
+		if got := NormalisePhrase(in); got != want {
+			t.Errorf("NormalisePhrase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
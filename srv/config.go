@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Ryan-Har/adit/srv/relay"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings for adit-srv. Values are taken from the
+// defaults, then an optional YAML or TOML config file, then ADIT_*
+// environment variables and finally command line flags.
+type Config struct {
+	ListenAddr string `yaml:"listen_addr" toml:"listen_addr"`
+	// TLSCert and TLSKey enable TLS when both are set, the files are
+	// reloaded when they change
+	TLSCert   string `yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey    string `yaml:"tls_key" toml:"tls_key"`
+	LogLevel  string `yaml:"log_level" toml:"log_level"`
+	LogFormat string `yaml:"log_format" toml:"log_format"`
+	// AllowedOrigins restricts the Origin header of websocket requests,
+	// requests without the header, such as those from the CLI, are allowed
+	AllowedOrigins []string      `yaml:"allowed_origins" toml:"allowed_origins"`
+	SessionTTL     time.Duration `yaml:"session_ttl" toml:"session_ttl"`
+	PhraseLength   int           `yaml:"phrase_length" toml:"phrase_length"`
+	// MinPhraseEntropy is the estimated entropy in bits a phrase chosen by a
+	// sender must have, generated phrases must also meet it
+	MinPhraseEntropy float64 `yaml:"min_phrase_entropy" toml:"min_phrase_entropy"`
+	TrustProxy       bool    `yaml:"trust_proxy" toml:"trust_proxy"`
+	// LookupRate and LookupBurst limit how often each address and each
+	// connection may look up a phrase
+	LookupRate  float64 `yaml:"lookup_rate" toml:"lookup_rate"`
+	LookupBurst int     `yaml:"lookup_burst" toml:"lookup_burst"`
+	// MissesBeforeLockout lookups of phrases which do not exist are allowed
+	// before lookups are refused for BaseLockout, doubling with each further
+	// miss up to MaxLockout
+	MissesBeforeLockout int           `yaml:"misses_before_lockout" toml:"misses_before_lockout"`
+	BaseLockout         time.Duration `yaml:"base_lockout" toml:"base_lockout"`
+	MaxLockout          time.Duration `yaml:"max_lockout" toml:"max_lockout"`
+	// MaxPrefixFailures is how many failed lookups sharing the nameplate and
+	// first word of a live phrase invalidate that session
+	MaxPrefixFailures int `yaml:"max_prefix_failures" toml:"max_prefix_failures"`
+	// MaxMessageSize and ReadTimeout bound each websocket message, a client
+	// which sends nothing, not even a pong, for ReadTimeout is disconnected
+	MaxMessageSize int64         `yaml:"max_message_size" toml:"max_message_size"`
+	ReadTimeout    time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	// PingInterval is how often websocket pings are sent to each client, it
+	// must be shorter than ReadTimeout
+	PingInterval time.Duration `yaml:"ping_interval" toml:"ping_interval"`
+	// MaxCandidates is how many ICE candidates each peer may send in a session
+	MaxCandidates int `yaml:"max_candidates" toml:"max_candidates"`
+	// ResumeGrace is how long a session is held for a sender which lost its
+	// connection to resume it, resuming is disabled when it is zero
+	ResumeGrace time.Duration `yaml:"resume_grace" toml:"resume_grace"`
+	// ShutdownGrace is how long sessions in progress are given to finish
+	// pairing after SIGTERM
+	ShutdownGrace time.Duration `yaml:"shutdown_grace" toml:"shutdown_grace"`
+	// Access control for /ws, a client is allowed if it presents one of
+	// AuthTokens, a token signed with AuthHMACSecret or a client certificate
+	// signed by ClientCA. Anyone may connect when none are set.
+	AuthTokens     []string `yaml:"auth_tokens" toml:"auth_tokens"`
+	AuthHMACSecret string   `yaml:"auth_hmac_secret" toml:"auth_hmac_secret"`
+	ClientCA       string   `yaml:"client_ca" toml:"client_ca"`
+	// RedisURL points every relay instance at the same Redis server so a
+	// sender and collector may connect to different instances. Sessions are
+	// kept in memory when it is empty.
+	RedisURL string `yaml:"redis_url" toml:"redis_url"`
+
+	// issueToken is set by -issue-token to print a signed token and exit
+	issueToken time.Duration
+}
+
+func defaultConfig() *Config {
+	opts := relay.DefaultOptions()
+	return &Config{
+		ListenAddr:       ":8080",
+		LogLevel:         "info",
+		LogFormat:        "text",
+		SessionTTL:       opts.SessionTTL,
+		PhraseLength:     opts.PhraseLength,
+		MinPhraseEntropy: opts.MinPhraseEntropy,
+		ShutdownGrace:    25 * time.Second,
+		ResumeGrace:      opts.ResumeGrace,
+		MaxMessageSize:   opts.Limits.MaxMessageSize,
+		ReadTimeout:      opts.Limits.ReadTimeout,
+		PingInterval:     opts.Limits.PingInterval,
+		MaxCandidates:    opts.Limits.MaxCandidates,
+
+		LookupRate:          opts.Limits.Lookups.Rate,
+		LookupBurst:         opts.Limits.Lookups.Burst,
+		MissesBeforeLockout: opts.Limits.Lookups.MissesBeforeLockout,
+		BaseLockout:         opts.Limits.Lookups.BaseLockout,
+		MaxLockout:          opts.Limits.Lookups.MaxLockout,
+		MaxPrefixFailures:   opts.Limits.Lookups.MaxPrefixFailures,
+	}
+}
+
+// option is a setting which can be given as a flag or environment variable
+type option struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var options = []option{
+	{"listen-addr", "address to listen on", func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"tls-cert", "path to the TLS certificate, enables TLS with -tls-key", func(c *Config, v string) error {
+		c.TLSCert = v
+		return nil
+	}},
+	{"tls-key", "path to the TLS private key", func(c *Config, v string) error {
+		c.TLSKey = v
+		return nil
+	}},
+	{"log-level", "log level, one of debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{"log-format", "log format, either text or json", func(c *Config, v string) error {
+		c.LogFormat = v
+		return nil
+	}},
+	{"allowed-origins", "comma separated origins allowed to open a websocket, all are allowed when empty", func(c *Config, v string) error {
+		c.AllowedOrigins = splitList(v)
+		return nil
+	}},
+	{"session-ttl", "how long a session may wait to be paired", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.SessionTTL = d
+		return nil
+	}},
+	{"phrase-length", "number of words in a generated phrase", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		c.PhraseLength = n
+		return nil
+	}},
+	{"min-phrase-entropy", "estimated bits of entropy a phrase chosen by a sender must have", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		c.MinPhraseEntropy = f
+		return nil
+	}},
+	{"max-message-size", "largest websocket message in bytes a client may send", func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		c.MaxMessageSize = n
+		return nil
+	}},
+	{"read-timeout", "how long a client may go without sending anything before it is disconnected", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.ReadTimeout = d
+		return nil
+	}},
+	{"ping-interval", "how often to ping clients to check they are still connected", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.PingInterval = d
+		return nil
+	}},
+	{"max-candidates", "number of ICE candidates each peer may send in a session", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		c.MaxCandidates = n
+		return nil
+	}},
+	{"resume-grace", "how long a sender which lost its connection has to resume its session, 0 disables resuming", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.ResumeGrace = d
+		return nil
+	}},
+	{"shutdown-grace", "how long sessions in progress may take to finish pairing on shutdown", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.ShutdownGrace = d
+		return nil
+	}},
+	{"auth-tokens", "comma separated bearer tokens allowed to connect", func(c *Config, v string) error {
+		c.AuthTokens = splitList(v)
+		return nil
+	}},
+	{"auth-hmac-secret", "secret used to sign and verify expiring bearer tokens", func(c *Config, v string) error {
+		c.AuthHMACSecret = v
+		return nil
+	}},
+	{"client-ca", "path to a CA certificate, clients presenting a certificate it signed may connect", func(c *Config, v string) error {
+		c.ClientCA = v
+		return nil
+	}},
+	{"redis-url", "redis server shared by relay instances, such as redis://localhost:6379/0, sessions are kept in memory when empty", func(c *Config, v string) error {
+		c.RedisURL = v
+		return nil
+	}},
+	{"trust-proxy", "take the client address from the last X-Forwarded-For entry, only enable behind a load balancer which appends it", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		c.TrustProxy = b
+		return nil
+	}},
+	{"lookup-rate", "phrase lookups per second allowed for each address and connection", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		c.LookupRate = f
+		return nil
+	}},
+	{"lookup-burst", "phrase lookups each address and connection may make at once", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		c.LookupBurst = n
+		return nil
+	}},
+	{"misses-before-lockout", "lookups of phrases which do not exist allowed before an address or connection is locked out", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		c.MissesBeforeLockout = n
+		return nil
+	}},
+	{"base-lockout", "how long lookups are refused after too many misses, doubling with each further miss", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.BaseLockout = d
+		return nil
+	}},
+	{"max-lockout", "longest lookups are refused after too many misses", func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.MaxLockout = d
+		return nil
+	}},
+	{"max-prefix-failures", "failed lookups sharing the nameplate and first word of a live phrase after which its session is invalidated", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		c.MaxPrefixFailures = n
+		return nil
+	}},
+}
+
+// envName returns the environment variable for an option, listen-addr is
+// read from ADIT_LISTEN_ADDR
+func envName(name string) string {
+	return "ADIT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// LoadConfig builds the configuration from the command line arguments, the
+// environment and the config file they point to, then validates it
+func LoadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("adit-srv", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("ADIT_CONFIG"), "path to a YAML or TOML config file")
+	issueToken := fs.Duration("issue-token", 0, "print a token signed with the HMAC secret which is valid for this long, then exit")
+
+	// flags are applied last so that they override the file and environment
+	flagValues := make(map[string]string)
+	for _, o := range options {
+		fs.Func(o.name, fmt.Sprintf("%s (env %s)", o.usage, envName(o.name)), func(v string) error {
+			flagValues[o.name] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range options {
+		v, ok := os.LookupEnv(envName(o.name))
+		if !ok {
+			continue
+		}
+		if err := o.set(c, v); err != nil {
+			return nil, fmt.Errorf("invalid value %q for %s: %w", v, envName(o.name), err)
+		}
+	}
+
+	for _, o := range options {
+		v, ok := flagValues[o.name]
+		if !ok {
+			continue
+		}
+		if err := o.set(c, v); err != nil {
+			return nil, fmt.Errorf("invalid value %q for -%s: %w", v, o.name, err)
+		}
+	}
+
+	c.issueToken = *issueToken
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// a misspelled setting would otherwise be silently ignored
+		d := yaml.NewDecoder(bytes.NewReader(data))
+		d.KnownFields(true)
+		if err = d.Decode(c); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			return fmt.Errorf("unknown setting %s in config file %s", undecoded[0], path)
+		}
+	default:
+		return fmt.Errorf("config file %s must have a .yaml, .yml or .toml extension", path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen address %q is not a valid host:port", c.ListenAddr))
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("the TLS certificate and key must be set together"))
+	}
+	for _, f := range []string{c.TLSCert, c.TLSKey} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			errs = append(errs, fmt.Errorf("unable to read TLS file: %w", err))
+		}
+	}
+
+	if _, err := c.slogLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("log level %q is not one of debug, info, warn or error", c.LogLevel))
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("log format %q is not text or json", c.LogFormat))
+	}
+
+	if c.ClientCA != "" {
+		if c.TLSCert == "" {
+			errs = append(errs, errors.New("client certificate authentication requires TLS to be enabled"))
+		}
+		if _, err := os.Stat(c.ClientCA); err != nil {
+			errs = append(errs, fmt.Errorf("unable to read client CA: %w", err))
+		}
+	}
+	if c.issueToken < 0 {
+		errs = append(errs, errors.New("the token lifetime must be greater than zero"))
+	}
+
+	if c.RedisURL != "" {
+		if _, err := redis.ParseURL(c.RedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid redis url: %w", err))
+		}
+	}
+
+	if c.ShutdownGrace < 0 {
+		errs = append(errs, errors.New("the shutdown grace period cannot be negative"))
+	}
+	if err := c.relayOptions().Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) slogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+// newLogger returns a logger writing in the configured format and level
+func (c *Config) newLogger(w io.Writer) *slog.Logger {
+	level, _ := c.slogLevel()
+	opts := &slog.HandlerOptions{Level: level}
+	if c.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// relayOptions returns the options for the relay, without its store
+func (c *Config) relayOptions() relay.Options {
+	opts := relay.DefaultOptions()
+	opts.Auth = relay.Auth{
+		Tokens:             c.AuthTokens,
+		HMACSecret:         c.AuthHMACSecret,
+		ClientCertificates: c.ClientCA != "",
+	}
+	opts.AllowedOrigins = c.AllowedOrigins
+	opts.PhraseLength = c.PhraseLength
+	opts.MinPhraseEntropy = c.MinPhraseEntropy
+	opts.SessionTTL = c.SessionTTL
+	opts.ResumeGrace = c.ResumeGrace
+	opts.Limits.MaxMessageSize = c.MaxMessageSize
+	opts.Limits.ReadTimeout = c.ReadTimeout
+	opts.Limits.PingInterval = c.PingInterval
+	opts.Limits.MaxCandidates = c.MaxCandidates
+	opts.Limits.Lookups = relay.LookupLimits{
+		Rate:                c.LookupRate,
+		Burst:               c.LookupBurst,
+		MissesBeforeLockout: c.MissesBeforeLockout,
+		BaseLockout:         c.BaseLockout,
+		MaxLockout:          c.MaxLockout,
+		MaxPrefixFailures:   c.MaxPrefixFailures,
+		TrustProxy:          c.TrustProxy,
+	}
+	return opts
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
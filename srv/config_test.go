@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	c, err := LoadConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, defaultConfig(), c)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "adit.yaml", `
+listen_addr: ":9000"
+log_level: debug
+session_ttl: 5m
+phrase_length: 4
+allowed_origins:
+  - https://example.com
+`)
+	t.Setenv("ADIT_LOG_LEVEL", "warn")
+	t.Setenv("ADIT_PHRASE_LENGTH", "6")
+
+	c, err := LoadConfig([]string{"-config", path, "-phrase-length", "7"})
+	require.NoError(t, err)
+	assert.Equal(t, ":9000", c.ListenAddr, "file should override the default")
+	assert.Equal(t, 5*time.Minute, c.SessionTTL)
+	assert.Equal(t, []string{"https://example.com"}, c.AllowedOrigins)
+	assert.Equal(t, "warn", c.LogLevel, "environment should override the file")
+	assert.Equal(t, 7, c.PhraseLength, "flag should override the environment")
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := writeConfigFile(t, "adit.toml", `
+listen_addr = "127.0.0.1:9001"
+session_ttl = "90s"
+trust_proxy = true
+lookup_burst = 50
+max_lockout = "1h"
+`)
+	t.Setenv("ADIT_CONFIG", path)
+
+	c, err := LoadConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9001", c.ListenAddr)
+	assert.Equal(t, 90*time.Second, c.SessionTTL)
+	assert.True(t, c.TrustProxy)
+	limits := c.relayOptions().Limits.Lookups
+	assert.Equal(t, 50, limits.Burst)
+	assert.Equal(t, time.Hour, limits.MaxLockout)
+	assert.True(t, limits.TrustProxy)
+}
+
+func TestLoadConfigRejectsUnknownSettings(t *testing.T) {
+	tests := map[string]string{
+		"adit.yaml": "listen_addr: \":9000\"\nsesion_ttl: 5m\n",
+		"adit.toml": "listen_addr = \":9000\"\nsesion_ttl = \"5m\"\n",
+	}
+	for name, contents := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadConfig([]string{"-config", writeConfigFile(t, name, contents)})
+			assert.ErrorContains(t, err, "sesion_ttl")
+		})
+	}
+
+	// an empty file sets nothing
+	_, err := LoadConfig([]string{"-config", writeConfigFile(t, "adit.yaml", "")})
+	assert.NoError(t, err)
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := map[string][]string{
+		"listen address":  {"-listen-addr", "8080"},
+		"tls pair":        {"-tls-cert", "cert.pem"},
+		"log level":       {"-log-level", "loud"},
+		"log format":      {"-log-format", "xml"},
+		"origin":          {"-allowed-origins", "example.com"},
+		"session ttl":     {"-session-ttl", "0s"},
+		"phrase length":   {"-phrase-length", "1"},
+		"unparsable bool": {"-trust-proxy", "maybe"},
+		"phrase entropy":  {"-phrase-length", "3", "-min-phrase-entropy", "64"},
+		"lookup rate":     {"-lookup-rate", "0"},
+		"prefix failures": {"-max-prefix-failures", "-1"},
+		"lockouts":        {"-base-lockout", "1h", "-max-lockout", "1m"},
+	}
+
+	for name, args := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadConfig(args)
+			assert.Error(t, err)
+		})
+	}
+}
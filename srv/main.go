@@ -1,76 +1,135 @@
 package main
 
 import (
-	"embed"
-	"encoding/json"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"math/rand"
-	"strings"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/Ryan-Har/adit/srv/relay"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"log/slog"
 	"net/http"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Add validation logic here if needed
-		return true
-	},
+// redisConnectTimeout bounds connecting to the Redis server at startup
+const redisConnectTimeout = 5 * time.Second
+
+// printToken writes a signed token valid for ttl, used by -issue-token
+func printToken(c *Config, ttl time.Duration) error {
+	if c.AuthHMACSecret == "" {
+		return errors.New("an HMAC secret must be configured to issue tokens")
+	}
+	expiry := time.Now().Add(ttl)
+	fmt.Println(relay.IssueToken([]byte(c.AuthHMACSecret), expiry))
+	return nil
 }
 
-var ongoingSessions = make(map[string]*Peers)
+// drain stops new sessions being created, waits up to grace for the
+// sessions in progress to finish pairing, then closes every remaining
+// connection telling the client to retry
+func drain(server *http.Server, r *relay.Relay, grace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	slog.Info("draining, waiting for sessions in progress", "grace", grace)
+	r.Drain(ctx)
 
-func wsUpgrade(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		slog.Error("websocket upgrade error", "error", err)
-		return
-	}
-	slog.Info("new websocket connection", "remoteAddr", conn.RemoteAddr())
-	//don't close here, handleConnection will close
-	p := Peer{
-		Conn: conn,
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down http server", "error", err)
 	}
-
-	go p.handleConnection()
+	r.Close()
+	slog.Info("shutdown complete")
 }
 
-//go:embed wordlist.json
-var wordlistFile embed.FS
-
-func GetNumberOfWords(num int) (string, error) {
-	data, err := wordlistFile.ReadFile("wordlist.json")
+func main() {
+	cfg, err := LoadConfig(os.Args[1:])
 	if err != nil {
-		return "", fmt.Errorf("error readint wordlist file %v", err.Error())
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
 	}
+	if cfg.issueToken > 0 {
+		if err := printToken(cfg, cfg.issueToken); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+	logger := cfg.newLogger(os.Stdout)
+	slog.SetDefault(logger)
 
-	var words []string
-	err = json.Unmarshal(data, &words)
+	opts := cfg.relayOptions()
+	opts.Logger = logger
+	opts.Registerer = prometheus.DefaultRegisterer
+	if cfg.RedisURL != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+		store, err := relay.NewRedisStore(ctx, cfg.RedisURL, cfg.SessionTTL, logger)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		defer store.Close()
+		opts.Store = store
+	}
+	r, err := relay.New(opts)
 	if err != nil {
-		return "", fmt.Errorf("error unmarshalling words to slice %v", err.Error())
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
 	}
 
-	var chosenWords []string
-	for range num {
-		chosenWords = append(chosenWords, words[rand.Intn(len(words)-1)])
-	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", r)
 
-	return strings.Join(chosenWords, "."), nil
+	server := &http.Server{Addr: cfg.ListenAddr, Handler: mux}
+	if cfg.TLSCert != "" {
+		reloader, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		go reloader.watch(30 * time.Second)
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+		if cfg.ClientCA != "" {
+			server.TLSConfig.ClientCAs, err = loadCertPool(cfg.ClientCA)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			// clients without a certificate may still use a bearer token
+			server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
 
-}
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server listening", "addr", cfg.ListenAddr, "tls", cfg.TLSCert != "")
+		if cfg.TLSCert != "" {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
 
-func healthCheck(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func main() {
-	http.HandleFunc("/ws", wsUpgrade)
-	http.HandleFunc("/health", healthCheck)
-	fmt.Println("Server listening on port 8080")
-	http.ListenAndServe(":8080", nil)
+	select {
+	case err := <-serveErr:
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+		stop()
+		drain(server, r, cfg.ShutdownGrace)
+	}
 }
@@ -0,0 +1,109 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MinHMACSecretLength is the shortest secret accepted for signing tokens
+const MinHMACSecretLength = 32
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid bearer token")
+	errExpiredToken = errors.New("expired bearer token")
+)
+
+// Auth is the access control for /ws, a client is allowed if it presents
+// one of Tokens, a token signed with HMACSecret or, when ClientCertificates
+// is set, a client certificate verified by the TLS server. Anyone may
+// connect when none are set.
+type Auth struct {
+	Tokens     []string
+	HMACSecret string
+	// ClientCertificates accepts requests whose certificate was verified,
+	// the server's tls.Config must be set up to verify them
+	ClientCertificates bool
+}
+
+// required reports whether any access control method is configured
+func (a Auth) required() bool {
+	return len(a.Tokens) > 0 || a.HMACSecret != "" || a.ClientCertificates
+}
+
+// authorize checks a websocket request against the configured methods, a
+// request is allowed if it satisfies any one of them
+func (a Auth) authorize(r *http.Request) error {
+	if !a.required() {
+		return nil
+	}
+
+	if a.ClientCertificates && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return nil
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		return errMissingToken
+	}
+
+	for _, allowed := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+			return nil
+		}
+	}
+
+	if a.HMACSecret != "" {
+		return verifyToken([]byte(a.HMACSecret), token, time.Now())
+	}
+	return errInvalidToken
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// IssueToken returns a token signed with secret which expires at expiry.
+// Tokens have the form <unix expiry>.<base64url HMAC-SHA256 of the expiry>.
+func IssueToken(secret []byte, expiry time.Time) string {
+	payload := strconv.FormatInt(expiry.Unix(), 10)
+	return payload + "." + signPayload(secret, payload)
+}
+
+func verifyToken(secret []byte, token string, now time.Time) error {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return errInvalidToken
+	}
+
+	expected := signPayload(secret, payload)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errInvalidToken
+	}
+
+	expiry, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return errInvalidToken
+	}
+	if now.After(time.Unix(expiry, 0)) {
+		return errExpiredToken
+	}
+	return nil
+}
+
+func signPayload(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSecret = []byte(strings.Repeat("s", MinHMACSecretLength))
+
+func TestVerifyToken(t *testing.T) {
+	now := time.Now()
+	token := IssueToken(testSecret, now.Add(time.Hour))
+
+	assert.NoError(t, verifyToken(testSecret, token, now))
+	assert.ErrorIs(t, verifyToken(testSecret, token, now.Add(2*time.Hour)), errExpiredToken)
+	assert.ErrorIs(t, verifyToken([]byte(strings.Repeat("x", MinHMACSecretLength)), token, now), errInvalidToken)
+
+	_, signature, _ := strings.Cut(token, ".")
+	extended := IssueToken(testSecret, now.Add(48*time.Hour))
+	expiry, _, _ := strings.Cut(extended, ".")
+	assert.ErrorIs(t, verifyToken(testSecret, expiry+"."+signature, now), errInvalidToken, "the expiry must be covered by the signature")
+	assert.ErrorIs(t, verifyToken(testSecret, "not-a-token", now), errInvalidToken)
+}
+
+func TestAuthorize(t *testing.T) {
+	var a Auth
+	r := httptest.NewRequest("GET", "/ws", nil)
+	assert.NoError(t, a.authorize(r), "no access control is configured")
+
+	a.Tokens = []string{"static-token"}
+	assert.ErrorIs(t, a.authorize(r), errMissingToken)
+
+	r.Header.Set("Authorization", "Bearer static-token")
+	assert.NoError(t, a.authorize(r))
+
+	r.Header.Set("Authorization", "Bearer wrong-token")
+	assert.ErrorIs(t, a.authorize(r), errInvalidToken)
+
+	a.HMACSecret = string(testSecret)
+	r.Header.Set("Authorization", "bearer "+IssueToken(testSecret, time.Now().Add(time.Minute)))
+	assert.NoError(t, a.authorize(r))
+}
+
+func TestAuthorizeClientCertificate(t *testing.T) {
+	a := Auth{ClientCertificates: true}
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	assert.ErrorIs(t, a.authorize(r), errMissingToken)
+
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{}}}}
+	assert.NoError(t, a.authorize(r))
+}
@@ -0,0 +1,641 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+)
+
+type peer struct {
+	*websocket.Conn
+	relay   *Relay
+	writeMu sync.Mutex
+	// set by the handshake in the first ping
+	Version      int
+	Capabilities []string
+	// RemoteIP is the client address used for rate limiting
+	RemoteIP string
+	lookups  attemptLimiter
+
+	// the session the peer has joined, read from other goroutines by the
+	// expiry reaper and shutdown so guarded by sessionMu
+	sessionMu sync.Mutex
+	phrase    string
+	role      Role
+	// epoch is the session's SenderEpoch when this peer joined as sender
+	epoch       int
+	unsubscribe func()
+}
+
+// storeTimeout bounds each call to the session store
+const storeTimeout = 5 * time.Second
+
+// maxPhraseAttempts is how many phrases are generated before giving up on
+// finding one which is not already in use
+const maxPhraseAttempts = 5
+
+func (p *peer) session() (string, Role) {
+	p.sessionMu.Lock()
+	defer p.sessionMu.Unlock()
+	return p.phrase, p.role
+}
+
+// supports reports whether the capability was agreed in the handshake
+func (p *peer) supports(capability string) bool {
+	return slices.Contains(p.Capabilities, capability)
+}
+
+// join subscribes the peer to messages for its role in a session
+func (p *peer) join(ctx context.Context, phrase string, role Role, epoch int) error {
+	unsubscribe, err := p.relay.store.Subscribe(ctx, phrase, role, p.sendMessage)
+	if err != nil {
+		return err
+	}
+	p.sessionMu.Lock()
+	defer p.sessionMu.Unlock()
+	p.phrase = phrase
+	p.role = role
+	p.epoch = epoch
+	p.unsubscribe = unsubscribe
+	return nil
+}
+
+// leave unsubscribes the peer and marks it as disconnected from its session.
+// When the connection was lost rather than closed normally the other peer is
+// told, unless the session is held for the sender to resume.
+func (p *peer) leave(abnormal bool) {
+	p.sessionMu.Lock()
+	phrase, role, epoch, unsubscribe := p.phrase, p.role, p.epoch, p.unsubscribe
+	p.phrase, p.role, p.unsubscribe = "", "", nil
+	p.sessionMu.Unlock()
+	if phrase == "" {
+		return
+	}
+
+	unsubscribe()
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	var held, superseded bool
+	_, err := p.relay.store.Modify(ctx, phrase, func(s *Session) (bool, error) {
+		held, superseded = false, false
+		if role == RoleSender {
+			if s.SenderEpoch != epoch {
+				superseded = true
+				return false, nil
+			}
+			s.SenderConnected = false
+			if abnormal && s.ResumeTokenHash != "" {
+				held = true
+				s.SenderLeftAt = time.Now()
+				return false, nil
+			}
+		} else {
+			s.CollectorConnected = false
+		}
+		// a session held for the sender keeps the collector's answer
+		return !s.SenderConnected && s.SenderLeftAt.IsZero() && !s.CollectorConnected, nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrSessionNotFound) {
+			p.relay.log.Error("unable to leave session", "session", p.relay.sessionID(phrase), "error", err)
+		}
+		return
+	}
+
+	switch {
+	case superseded:
+		return
+	case held:
+		p.relay.log.Info("holding session for sender to resume", "session", p.relay.sessionID(phrase), "grace", p.relay.opts.ResumeGrace)
+		time.AfterFunc(p.relay.opts.ResumeGrace, func() {
+			p.relay.releaseHeldSession(phrase, epoch)
+		})
+	case abnormal:
+		p.relay.log.Info("peer disconnected", "session", p.relay.sessionID(phrase), "role", role)
+		p.relay.notifyDisconnected(ctx, phrase, role)
+	}
+}
+
+// notifyDisconnected tells the other peer in a session that role has lost
+// its connection
+func (r *Relay) notifyDisconnected(ctx context.Context, phrase string, role Role) {
+	err := r.store.Publish(ctx, phrase, role.other(), &protocol.Message{
+		MessageType: protocol.TypePeerDisconnected,
+		Phrase:      phrase,
+		Content:     string(role),
+	})
+	if err != nil {
+		r.log.Error("unable to notify peer of disconnect", "session", r.sessionID(phrase), "error", err)
+	}
+}
+
+// writeTimeout bounds writing a control frame to a client
+const writeTimeout = 10 * time.Second
+
+// pingEvery sends websocket pings until done is closed. Each pong extends the
+// read deadline, so a client which stops responding is disconnected once
+// ReadTimeout passes.
+func (p *peer) pingEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := p.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				p.relay.log.Info("unable to ping client", "remoteAddr", p.RemoteAddr(), "error", err)
+				return
+			}
+		}
+	}
+}
+
+func (p *peer) handleConnection() {
+	done := make(chan struct{})
+	// a normal closure means the client finished signaling, anything else
+	// is reported to the other peer
+	closedNormally := false
+	defer func() {
+		close(done)
+		p.Close()
+		p.relay.metrics.activeConnections.Dec()
+		p.relay.untrackPeer(p)
+		p.leave(!closedNormally)
+	}()
+
+	p.SetPongHandler(func(string) error {
+		return p.SetReadDeadline(time.Now().Add(p.relay.opts.Limits.ReadTimeout))
+	})
+	go p.pingEvery(p.relay.opts.Limits.PingInterval, done)
+
+	for {
+		// Read message
+		p.SetReadDeadline(time.Now().Add(p.relay.opts.Limits.ReadTimeout))
+		messageType, message, err := p.ReadMessage()
+		if err != nil {
+			closedNormally = websocket.IsCloseError(err, websocket.CloseNormalClosure)
+			if errors.Is(err, websocket.ErrReadLimit) {
+				p.relay.log.Info("closing connection which sent an oversized message", "remoteAddr", p.RemoteAddr())
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				p.relay.log.Info("closing unresponsive connection", "remoteAddr", p.RemoteAddr())
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+				p.relay.log.Info("read error", "remoteAddr", p.RemoteAddr(), "error", err)
+			} else {
+				p.relay.log.Info("connection closed", "remoteAddr", p.RemoteAddr())
+			}
+			break
+		}
+
+		switch messageType {
+		case websocket.CloseMessage:
+			p.relay.log.Info("websocket close message from", "remoteAddr", p.RemoteAddr())
+		case websocket.TextMessage:
+			p.relay.log.Info("message received from", "remoteddr", p.RemoteAddr())
+			p.handleTextMessage(message)
+			p.relay.log.Info("response generated for", "remoteaddr", p.RemoteAddr())
+		}
+	}
+
+}
+
+func (p *peer) handleTextMessage(message []byte) {
+	msg := &protocol.Message{}
+
+	err := json.Unmarshal(message, &msg)
+	if err != nil {
+		p.sendError(protocol.CodeMalformedMessage, fmt.Sprintf("unable to parse message: %v", err), false)
+		return
+	}
+	p.relay.log.Info("text message handled", "type", msg.MessageType, "session", p.relay.sessionID(msg.Phrase), "message", p.relay.redacted(msg).Content)
+	p.relay.metrics.messagesReceived.WithLabelValues(messageTypeLabel(msg.MessageType)).Inc()
+
+	if p.Version == 0 && msg.MessageType != protocol.TypePing {
+		p.sendError(protocol.CodeHandshakeRequired, "handshake required, the first message must be a ping", false)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	switch msg.MessageType {
+	case protocol.TypePing:
+		if p.Version == 0 {
+			p.handshake(msg)
+			return
+		}
+		p.sendMessage(&protocol.Message{
+			MessageType: protocol.TypePong,
+		})
+		return
+	case protocol.TypeOffer:
+		if p.relay.draining.Load() {
+			p.sendError(protocol.CodeServerDraining, "relay server is shutting down, retry to reach another instance", true)
+			return
+		}
+
+		offer, err := decodeOffer(msg)
+		if err != nil {
+			p.sendError(protocol.CodeMalformedMessage, fmt.Sprintf("invalid offer: %v", err), false)
+			return
+		}
+		sdpString, err := validateSDP(offer.SDP)
+		if err != nil {
+			p.sendError(protocol.CodeMalformedSDP, fmt.Sprintf("invalid sdp: %v", err), false)
+			return
+		}
+
+		var resumeToken, resumeTokenHash string
+		if p.relay.opts.ResumeGrace > 0 && p.supports(protocol.CapResume) {
+			resumeToken, resumeTokenHash, err = newResumeToken()
+			if err != nil {
+				p.relay.log.Error("unable to generate resume token", "error", err)
+				p.sendError(protocol.CodeInternal, "unable to create the session", true)
+				return
+			}
+		}
+		newSession := func(phrase string) error {
+			return p.relay.store.Create(ctx, &Session{
+				Phrase:          phrase,
+				CreatedAt:       time.Now(),
+				OfferSdp:        sdpString,
+				SenderConnected: true,
+				ResumeTokenHash: resumeTokenHash,
+			})
+		}
+
+		var words string
+		if offer.Phrase != "" {
+			words = protocol.NormalisePhrase(offer.Phrase)
+			if err := p.relay.words.checkChosenPhrase(words, p.relay.opts.MinPhraseEntropy); err != nil {
+				p.sendError(protocol.CodePhraseRejected, err.Error(), false)
+				return
+			}
+			// a sender choosing phrases can test whether they are in use, so
+			// it counts against the same limit as collectors guessing them
+			if ok, wait := p.allowLookup(); !ok {
+				p.relay.metrics.lookupsRejected.Inc()
+				p.sendError(protocol.CodeRateLimited, fmt.Sprintf("too many attempts, try again in %s", wait.Round(time.Second)), true)
+				return
+			}
+			err = newSession(words)
+			if errors.Is(err, ErrSessionExists) {
+				// finding a phrase in use is what a guesser is after, so it
+				// is penalised as a miss would be
+				now := time.Now()
+				p.relay.limiters.miss(p.RemoteIP, now)
+				p.lookups.miss(now, p.relay.opts.Limits.Lookups)
+				p.sendError(protocol.CodePhraseInUse, "phrase is already in use, choose another", false)
+				return
+			}
+		} else {
+			length := p.relay.opts.PhraseLength
+			if offer.Words != 0 {
+				if err := p.relay.words.checkPhraseWords(offer.Words, p.relay.opts.MinPhraseEntropy); err != nil {
+					p.sendError(protocol.CodePhraseRejected, err.Error(), false)
+					return
+				}
+				length = offer.Words
+			}
+			for range maxPhraseAttempts {
+				words, err = p.relay.generatePhrase(ctx, length)
+				if err != nil {
+					break
+				}
+				err = newSession(words)
+				if !errors.Is(err, ErrSessionExists) {
+					break
+				}
+			}
+		}
+		if err != nil {
+			p.relay.log.Error("unable to create session", "error", err)
+			p.sendError(protocol.CodeInternal, "unable to generate a phrase", true)
+			return
+		}
+		p.relay.log.Info("word phrase generated", "session", p.relay.sessionID(words))
+
+		if err := p.join(ctx, words, RoleSender, 0); err != nil {
+			p.relay.log.Error("unable to subscribe to session", "session", p.relay.sessionID(words), "error", err)
+			p.relay.store.Delete(ctx, words)
+			p.sendError(protocol.CodeInternal, "unable to create the session", true)
+			return
+		}
+		p.relay.metrics.sessionsCreated.Inc()
+		p.sendPhraseCreate(words, resumeToken)
+		return
+	case protocol.TypeResume:
+		p.resume(ctx, msg)
+		return
+	case protocol.TypeGetOffer:
+		if msg.Phrase == "" {
+			p.sendError(protocol.CodePhraseNotFound, "phrase is empty, cannot collect without phrase", false)
+			return
+		}
+		if ok, wait := p.allowLookup(); !ok {
+			p.relay.metrics.lookupsRejected.Inc()
+			p.sendError(protocol.CodeRateLimited, fmt.Sprintf("too many attempts, try again in %s", wait.Round(time.Second)), true)
+			return
+		}
+
+		_, err := p.relay.store.Update(ctx, msg.Phrase, claimCollector)
+		switch {
+		case errors.Is(err, ErrSessionNotFound):
+			p.recordLookupMiss(ctx, msg.Phrase)
+			p.sendPhraseNotFound(msg.Phrase)
+			return
+		case errors.Is(err, ErrSessionClaimed):
+			// a phrase claimed by the attacker themselves must not reset
+			// their misses
+			p.sendError(protocol.CodePhraseClaimed, "phrase has already been claimed by another collector", false)
+			return
+		case err != nil:
+			p.relay.log.Error("unable to claim session", "session", p.relay.sessionID(msg.Phrase), "error", err)
+			p.sendError(protocol.CodeInternal, "unable to join the session", true)
+			return
+		}
+		p.recordLookupHit()
+
+		if err := p.join(ctx, msg.Phrase, RoleCollector, 0); err != nil {
+			p.relay.log.Error("unable to subscribe to session", "session", p.relay.sessionID(msg.Phrase), "error", err)
+			p.sendError(protocol.CodeInternal, "unable to join the session", true)
+			return
+		}
+		// the sender starts gathering as soon as it makes the offer, replay
+		// everything it sent before the collector joined
+		var pending []*protocol.Message
+		s, err := p.relay.store.Update(ctx, msg.Phrase, func(s *Session) error {
+			s.CollectorConnected = true
+			pending = s.CollectorCandidates
+			s.CollectorCandidates = nil
+			return nil
+		})
+		if err != nil {
+			p.sendError(protocol.CodePhraseNotFound, "phrase does not exist", false)
+			return
+		}
+
+		p.sendMessage(&protocol.Message{
+			MessageType: protocol.TypeOffer,
+			Phrase:      msg.Phrase,
+			Content:     s.OfferSdp,
+		})
+		for _, candidate := range pending {
+			p.sendMessage(candidate)
+		}
+		return
+	case protocol.TypeAnswer:
+		if msg.Phrase == "" {
+			p.sendError(protocol.CodePhraseNotFound, "phrase is empty, cannot collect without phrase", false)
+			return
+		}
+
+		// only the collector which claimed the session may answer it, or
+		// answers would be an unthrottled way to find and take over phrases
+		if phrase, role := p.session(); phrase != msg.Phrase || role != RoleCollector {
+			p.sendError(protocol.CodeNotSessionMember, "not a member of this session", false)
+			return
+		}
+		sdpString, err := validateSDP(msg.Content)
+		if err != nil {
+			p.sendError(protocol.CodeMalformedSDP, fmt.Sprintf("invalid sdp: %v", err), false)
+			return
+		}
+
+		var pending []*protocol.Message
+		// a repeated answer replaces the first but does not complete the
+		// session again
+		var first bool
+		s, err := p.relay.store.Update(ctx, msg.Phrase, func(s *Session) error {
+			if !s.SenderConnected && s.SenderLeftAt.IsZero() {
+				return ErrSessionNotFound
+			}
+			first = s.AnswerSdp == ""
+			s.AnswerSdp = sdpString
+			pending = nil
+			// a sender which is resuming is sent the answer when it does
+			if s.SenderConnected {
+				pending = s.SenderCandidates
+				s.SenderCandidates = nil
+			}
+			return nil
+		})
+		if err != nil {
+			p.sendError(protocol.CodePhraseNotFound, "phrase does not exist", false)
+			return
+		}
+		if first {
+			p.relay.metrics.sessionsCompleted.Inc()
+			p.relay.metrics.offerToAnswer.Observe(time.Since(s.CreatedAt).Seconds())
+		}
+		if !s.SenderConnected {
+			p.relay.log.Info("holding answer until sender resumes", "session", p.relay.sessionID(msg.Phrase))
+			return
+		}
+
+		p.publish(ctx, msg.Phrase, RoleSender, &protocol.Message{
+			MessageType: protocol.TypeAnswer,
+			Phrase:      msg.Phrase,
+			Content:     sdpString,
+		})
+		for _, candidate := range pending {
+			p.publish(ctx, msg.Phrase, RoleSender, candidate)
+		}
+		return
+	case protocol.TypeICECandidate:
+		if msg.Phrase == "" {
+			p.sendError(protocol.CodePhraseNotFound, "phrase is empty, cannot collect without phrase", false)
+			return
+		}
+
+		phrase, role := p.session()
+		if phrase != msg.Phrase {
+			p.sendError(protocol.CodeNotSessionMember, "not a member of this session", false)
+			return
+		}
+		if err := validateCandidate(msg.Content); err != nil {
+			p.sendError(protocol.CodeMalformedCandidate, fmt.Sprintf("invalid candidate: %v", err), false)
+			return
+		}
+
+		var forward bool
+		_, err := p.relay.store.Update(ctx, msg.Phrase, func(s *Session) error {
+			forward = false
+			if err := s.countCandidate(role, p.relay.opts.Limits.MaxCandidates); err != nil {
+				return err
+			}
+			if role == RoleSender && !s.CollectorConnected {
+				p.relay.log.Info("queueing candidate until collector joins", "session", p.relay.sessionID(msg.Phrase))
+				s.CollectorCandidates = append(s.CollectorCandidates, msg)
+				return nil
+			}
+			if role == RoleCollector && (!s.SenderConnected || s.AnswerSdp == "") {
+				p.relay.log.Info("queueing candidate until sender receives answer", "session", p.relay.sessionID(msg.Phrase))
+				s.SenderCandidates = append(s.SenderCandidates, msg)
+				return nil
+			}
+			forward = true
+			return nil
+		})
+		if errors.Is(err, errTooManyCandidates) {
+			p.sendError(protocol.CodeLimitExceeded, fmt.Sprintf("no more than %d candidates may be sent in a session", p.relay.opts.Limits.MaxCandidates), false)
+			return
+		}
+		if err != nil {
+			p.sendError(protocol.CodePhraseNotFound, "phrase does not exist", false)
+			return
+		}
+
+		if forward {
+			p.publish(ctx, msg.Phrase, role.other(), msg)
+		}
+		return
+	}
+	p.sendError(protocol.CodeUnknownMessageType, fmt.Sprintf("message type %q is not understood", msg.MessageType), false)
+}
+
+// handshake agrees the protocol version and capabilities from the client's
+// first ping. Clients older than protocol.MinVersion are told to upgrade and
+// disconnected.
+func (p *peer) handshake(msg *protocol.Message) {
+	var hello protocol.Hello
+	if err := msg.DecodeContent(&hello); err != nil {
+		p.relay.log.Info("unable to decode client hello", "error", err)
+	}
+
+	if hello.Version < protocol.MinVersion || hello.Version > protocol.Version {
+		reason := fmt.Sprintf("protocol version %d is not supported by this relay, which supports versions %d to %d. please upgrade adit",
+			hello.Version, protocol.MinVersion, protocol.Version)
+		p.sendError(protocol.CodeUnsupportedVersion, reason, false)
+		p.writeMu.Lock()
+		p.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported protocol version"))
+		p.writeMu.Unlock()
+		p.Close()
+		return
+	}
+
+	p.Version = hello.Version
+	p.Capabilities = protocol.Negotiate(protocol.Capabilities, hello.Capabilities)
+	p.relay.log.Info("handshake complete", "remoteAddr", p.RemoteAddr(), "version", p.Version, "capabilities", p.Capabilities)
+
+	p.sendMessage(&protocol.Message{
+		MessageType: protocol.TypePong,
+		Content:     protocol.NewHello(),
+	})
+}
+
+// allowLookup applies both the per ip and per connection limits to a phrase
+// lookup
+func (p *peer) allowLookup() (bool, time.Duration) {
+	now := time.Now()
+	if ok, wait := p.relay.limiters.allow(p.RemoteIP, now); !ok {
+		return false, wait
+	}
+	return p.lookups.allow(now, p.relay.opts.Limits.Lookups)
+}
+
+// recordLookupHit forgives the connection its misses once it has found the
+// phrase it was given. The misses of its address are kept, or guesses could
+// be alternated with lookups of a phrase the guesser created to avoid the
+// lockout.
+func (p *peer) recordLookupHit() {
+	p.lookups.hit()
+}
+
+// recordLookupMiss penalises the peer for looking up a phrase which does not
+// exist. Misses sharing the lookupPrefix of a live phrase, its nameplate and
+// first word, count against that session, which is invalidated once it has
+// had too many.
+func (p *peer) recordLookupMiss(ctx context.Context, phrase string) {
+	now := time.Now()
+	p.relay.metrics.lookupMisses.Inc()
+	p.relay.limiters.miss(p.RemoteIP, now)
+	p.lookups.miss(now, p.relay.opts.Limits.Lookups)
+
+	phrases, err := p.relay.store.PhrasesWithPrefix(ctx, phrasePrefix(phrase))
+	if err != nil {
+		p.relay.log.Error("unable to list sessions", "error", err)
+		return
+	}
+	prefix := lookupPrefix(phrase)
+	for _, sessionPhrase := range phrases {
+		if lookupPrefix(sessionPhrase) != prefix {
+			continue
+		}
+		s, err := p.relay.store.Update(ctx, sessionPhrase, func(s *Session) error {
+			s.FailedLookups++
+			return nil
+		})
+		if err != nil || s.FailedLookups < p.relay.opts.Limits.Lookups.MaxPrefixFailures {
+			continue
+		}
+
+		p.relay.log.Info("invalidating session after repeated failed lookups", "session", p.relay.sessionID(sessionPhrase))
+		p.relay.metrics.sessionsInvalidated.Inc()
+		if err := p.relay.store.Delete(ctx, sessionPhrase); err != nil {
+			p.relay.log.Error("unable to delete session", "session", p.relay.sessionID(sessionPhrase), "error", err)
+		}
+		p.relay.publishError(ctx, sessionPhrase, RoleSender, protocol.CodeSessionInvalidated, "too many incorrect attempts were made to collect with this phrase")
+	}
+}
+
+// publish sends a message to the other peer in a session, telling this peer
+// if it could not be delivered
+func (p *peer) publish(ctx context.Context, phrase string, to Role, m *protocol.Message) {
+	if err := p.relay.store.Publish(ctx, phrase, to, m); err != nil {
+		p.relay.log.Error("unable to publish message", "session", p.relay.sessionID(phrase), "to", to, "error", err)
+		p.sendError(protocol.CodeInternal, "unable to reach the other peer", true)
+	}
+}
+
+// publishError sends an error to a peer in a session wherever it is connected
+func (r *Relay) publishError(ctx context.Context, phrase string, to Role, code, message string) {
+	r.metrics.errorsSent.WithLabelValues(code).Inc()
+	if err := r.store.Publish(ctx, phrase, to, protocol.NewError(code, message, false)); err != nil {
+		r.log.Error("unable to publish error", "session", r.sessionID(phrase), "to", to, "error", err)
+	}
+}
+
+// sendPhraseNotFound tells a collector its phrase does not exist, along with
+// the phrase it may have meant if it has a typo
+func (p *peer) sendPhraseNotFound(phrase string) {
+	e := &protocol.Error{Code: protocol.CodePhraseNotFound, Message: "phrase does not exist"}
+	if e.Suggestion = p.relay.words.suggestPhrase(phrase); e.Suggestion != "" {
+		e.Message += fmt.Sprintf(", did you mean %s?", e.Suggestion)
+	}
+	p.relay.metrics.errorsSent.WithLabelValues(e.Code).Inc()
+	p.sendMessage(&protocol.Message{MessageType: protocol.TypeError, Content: e})
+}
+
+// sendError tells the peer why its last message could not be handled
+func (p *peer) sendError(code, message string, retryable bool) {
+	p.relay.metrics.errorsSent.WithLabelValues(code).Inc()
+	p.sendMessage(protocol.NewError(code, message, retryable))
+}
+
+func (p *peer) sendMessage(m *protocol.Message) {
+	if m.MessageType == protocol.TypeError {
+		p.relay.log.Error("error in response message", "error", p.relay.redacted(m).Content)
+	}
+
+	jsonBytes, err := json.Marshal(m)
+	if err != nil {
+		p.relay.log.Error("error marshalling response message", "message", p.relay.redacted(m), "error", err)
+	}
+	p.writeMu.Lock()
+	err = p.WriteMessage(websocket.TextMessage, jsonBytes)
+	p.writeMu.Unlock()
+	if err != nil {
+		p.relay.log.Error("Write error:", "error", err)
+	}
+	p.relay.log.Info("message sent to", "remoteaddr", p.RemoteAddr(), "message", p.relay.redacted(m))
+}
@@ -0,0 +1,293 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRelay returns a relay with its own memory store, configure may
+// change the default options
+func newTestRelay(t testing.TB, configure ...func(*Options)) *Relay {
+	t.Helper()
+	opts := DefaultOptions()
+	for _, c := range configure {
+		c(&opts)
+	}
+	r, err := New(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// testPeers numbers the peers created by newTestPeer so each has its own
+// address for rate limiting
+var testPeers atomic.Int32
+
+// newTestPeer returns the relay side of a websocket connection along with the
+// client side
+func newTestPeer(t testing.TB, r *Relay) (*peer, *websocket.Conn) {
+	t.Helper()
+	remoteIP := fmt.Sprintf("test-peer-%d", testPeers.Add(1))
+	peers := make(chan *peer, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := r.upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		peers <- &peer{Conn: conn, relay: r, RemoteIP: remoteIP}
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	p := <-peers
+	t.Cleanup(func() { p.Close() })
+	return p, client
+}
+
+// handle passes msg to the peer and returns its reply
+func handle(t *testing.T, p *peer, client *websocket.Conn, msg *protocol.Message) *protocol.Message {
+	t.Helper()
+	data, err := json.Marshal(msg)
+	require.NoError(t, err)
+	p.handleTextMessage(data)
+
+	reply := &protocol.Message{}
+	require.NoError(t, client.ReadJSON(reply))
+	return reply
+}
+
+func hello() *protocol.Message {
+	return &protocol.Message{MessageType: protocol.TypePing, Content: protocol.NewHello()}
+}
+
+func TestOfferRejectsMalformedSDP(t *testing.T) {
+	r := newTestRelay(t)
+	p, client := newTestPeer(t, r)
+	handle(t, p, client, hello())
+
+	reply := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: "not an sdp"})
+	assert.Equal(t, protocol.CodeMalformedSDP, reply.ToError().Code)
+	phrase, _ := p.session()
+	assert.Empty(t, phrase, "no session should be created")
+
+	reply = handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: testOfferSdp})
+	require.Equal(t, protocol.TypePhraseCreate, reply.MessageType)
+	s, err := r.store.Get(context.Background(), reply.Phrase)
+	require.NoError(t, err)
+	assert.Equal(t, testOfferSdp, s.OfferSdp)
+}
+
+func TestCandidatesAreLimited(t *testing.T) {
+	r := newTestRelay(t, func(o *Options) { o.Limits.MaxCandidates = 2 })
+	p, client := newTestPeer(t, r)
+	handle(t, p, client, hello())
+	created := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: testOfferSdp})
+	require.Equal(t, protocol.TypePhraseCreate, created.MessageType)
+
+	reply := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeICECandidate, Phrase: created.Phrase, Content: "junk"})
+	assert.Equal(t, protocol.CodeMalformedCandidate, reply.ToError().Code)
+
+	candidate := &protocol.Message{MessageType: protocol.TypeICECandidate, Phrase: created.Phrase, Content: testCandidate}
+	for range r.opts.Limits.MaxCandidates {
+		data, err := json.Marshal(candidate)
+		require.NoError(t, err)
+		p.handleTextMessage(data)
+	}
+	s, err := r.store.Get(context.Background(), created.Phrase)
+	require.NoError(t, err)
+	assert.Len(t, s.CollectorCandidates, r.opts.Limits.MaxCandidates)
+
+	reply = handle(t, p, client, candidate)
+	assert.Equal(t, protocol.CodeLimitExceeded, reply.ToError().Code)
+}
+
+func FuzzHandleTextMessage(f *testing.F) {
+	seeds := []*protocol.Message{
+		hello(),
+		{MessageType: protocol.TypePing},
+		{MessageType: protocol.TypeOffer, Content: testOfferSdp},
+		{MessageType: protocol.TypeGetOffer, Phrase: "apple.banana"},
+		{MessageType: protocol.TypeAnswer, Phrase: "apple.banana", Content: testOfferSdp},
+		{MessageType: protocol.TypeICECandidate, Phrase: "apple.banana", Content: testCandidate},
+		{MessageType: "unknown"},
+	}
+	for _, seed := range seeds {
+		data, err := json.Marshal(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(`{"messagetype":"offer","content":{"sdp":1}}`))
+	f.Add([]byte(`{"messagetype":`))
+
+	r := newTestRelay(f)
+	p, client := newTestPeer(f, r)
+	// replies are not checked, discard them so writes never block
+	go func() {
+		for {
+			if _, _, err := client.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	f.Fuzz(func(t *testing.T, message []byte) {
+		if p.Version == 0 {
+			p.handshake(hello())
+		}
+		p.handleTextMessage(message)
+
+		phrase, _ := p.session()
+		if phrase == "" {
+			return
+		}
+		s, err := r.store.Get(context.Background(), phrase)
+		if err != nil {
+			return
+		}
+		if _, err := validateSDP(s.OfferSdp); err != nil {
+			t.Fatalf("stored an invalid offer: %v", err)
+		}
+		if s.SenderCandidateCount > r.opts.Limits.MaxCandidates || s.CollectorCandidateCount > r.opts.Limits.MaxCandidates {
+			t.Fatalf("accepted more than %d candidates", r.opts.Limits.MaxCandidates)
+		}
+	})
+}
+
+// startSession runs the connection handler for p and creates a session from
+// the client, returning the phrase create message and the messages published
+// to the collector
+func startSession(t *testing.T, p *peer, client *websocket.Conn) (*protocol.Message, <-chan *protocol.Message) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		p.handleConnection()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		p.Close()
+		<-done
+	})
+
+	reply := &protocol.Message{}
+	require.NoError(t, client.WriteJSON(hello()))
+	require.NoError(t, client.ReadJSON(reply))
+	require.NoError(t, client.WriteJSON(&protocol.Message{MessageType: protocol.TypeOffer, Content: testOfferSdp}))
+	require.NoError(t, client.ReadJSON(reply))
+	require.Equal(t, protocol.TypePhraseCreate, reply.MessageType)
+
+	collector := make(chan *protocol.Message, 1)
+	_, err := p.relay.store.Subscribe(context.Background(), reply.Phrase, RoleCollector, func(m *protocol.Message) {
+		collector <- m
+	})
+	require.NoError(t, err)
+	return reply, collector
+}
+
+func TestUnresponsivePeerIsDisconnected(t *testing.T) {
+	r := newTestRelay(t, func(o *Options) {
+		o.Limits.ReadTimeout, o.Limits.PingInterval, o.ResumeGrace = 200*time.Millisecond, 50*time.Millisecond, 0
+	})
+	p, client := newTestPeer(t, r)
+	created, collector := startSession(t, p, client)
+	phrase := created.Phrase
+
+	// the client stops reading so never answers the relay's pings
+	select {
+	case m := <-collector:
+		assert.Equal(t, protocol.TypePeerDisconnected, m.MessageType)
+		assert.Equal(t, phrase, m.Phrase)
+		assert.Equal(t, string(RoleSender), m.Content)
+	case <-time.After(2 * time.Second):
+		t.Fatal("collector was not told the sender disconnected")
+	}
+}
+
+func TestRespondingPeerStaysConnected(t *testing.T) {
+	r := newTestRelay(t, func(o *Options) {
+		o.Limits.ReadTimeout, o.Limits.PingInterval = 200*time.Millisecond, 50*time.Millisecond
+	})
+	p, client := newTestPeer(t, r)
+	created, collector := startSession(t, p, client)
+	phrase := created.Phrase
+
+	// reading lets the client answer pings
+	go func() {
+		for {
+			if _, _, err := client.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case m := <-collector:
+		t.Fatalf("unexpected message: %+v", m)
+	case <-time.After(500 * time.Millisecond):
+	}
+	_, err := r.store.Get(context.Background(), phrase)
+	assert.NoError(t, err)
+}
+
+func TestNormalCloseDoesNotNotifyPeer(t *testing.T) {
+	r := newTestRelay(t)
+	p, client := newTestPeer(t, r)
+	created, collector := startSession(t, p, client)
+	phrase := created.Phrase
+
+	require.NoError(t, client.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+
+	assert.Eventually(t, func() bool {
+		_, err := r.store.Get(context.Background(), phrase)
+		return errors.Is(err, ErrSessionNotFound)
+	}, 2*time.Second, 10*time.Millisecond)
+	select {
+	case m := <-collector:
+		t.Fatalf("unexpected message: %+v", m)
+	default:
+	}
+}
+
+func TestAnswerRequiresCollector(t *testing.T) {
+	r := newTestRelay(t)
+	sender, senderClient := newTestPeer(t, r)
+	created, _ := startSession(t, sender, senderClient)
+
+	answer := &protocol.Message{MessageType: protocol.TypeAnswer, Phrase: created.Phrase, Content: testOfferSdp}
+	p, client := newTestPeer(t, r)
+	handle(t, p, client, hello())
+	reply := handle(t, p, client, answer)
+	assert.Equal(t, protocol.CodeNotSessionMember, reply.ToError().Code, "a peer which has not claimed the session should not answer it")
+	reply = handle(t, p, client, &protocol.Message{MessageType: protocol.TypeAnswer, Phrase: "apple.banana", Content: testOfferSdp})
+	assert.Equal(t, protocol.CodeNotSessionMember, reply.ToError().Code)
+
+	// nor may the sender answer its own offer
+	data, err := json.Marshal(answer)
+	require.NoError(t, err)
+	require.NoError(t, senderClient.WriteMessage(websocket.TextMessage, data))
+	reply = &protocol.Message{}
+	require.NoError(t, senderClient.ReadJSON(reply))
+	assert.Equal(t, protocol.CodeNotSessionMember, reply.ToError().Code)
+
+	s, err := r.store.Get(context.Background(), created.Phrase)
+	require.NoError(t, err)
+	assert.Empty(t, s.AnswerSdp)
+	assert.False(t, s.CollectorClaimed)
+}
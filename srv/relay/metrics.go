@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics are the Prometheus metrics of a relay
+type metrics struct {
+	activeConnections   prometheus.Gauge
+	sessionsCreated     prometheus.Counter
+	sessionsCompleted   prometheus.Counter
+	sessionsResumed     prometheus.Counter
+	sessionsExpired     prometheus.Counter
+	messagesReceived    *prometheus.CounterVec
+	errorsSent          *prometheus.CounterVec
+	offerToAnswer       prometheus.Histogram
+	lookupsRejected     prometheus.Counter
+	lookupMisses        prometheus.Counter
+	authFailures        prometheus.Counter
+	sessionsInvalidated prometheus.Counter
+}
+
+// newMetrics registers the metrics with reg, they are still counted but not
+// exported when reg is nil. liveSessions is called on each scrape.
+func newMetrics(reg prometheus.Registerer, liveSessions func() float64) *metrics {
+	factory := promauto.With(reg)
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "adit_sessions_live",
+		Help: "Number of sessions waiting for or being paired.",
+	}, liveSessions)
+	return &metrics{
+		activeConnections: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "adit_websocket_connections",
+			Help: "Number of open websocket connections.",
+		}),
+		sessionsCreated: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_sessions_created_total",
+			Help: "Sessions created by a sender making an offer.",
+		}),
+		sessionsCompleted: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_sessions_completed_total",
+			Help: "Sessions where the collector's answer was delivered to the sender.",
+		}),
+		sessionsResumed: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_sessions_resumed_total",
+			Help: "Sessions reclaimed by a sender which lost its connection.",
+		}),
+		sessionsExpired: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_sessions_expired_total",
+			Help: "Sessions removed after waiting longer than the session TTL.",
+		}),
+		messagesReceived: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "adit_messages_received_total",
+			Help: "Signaling messages received, by message type.",
+		}, []string{"type"}),
+		errorsSent: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "adit_errors_sent_total",
+			Help: "Errors sent to clients, by error code.",
+		}, []string{"code"}),
+		offerToAnswer: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "adit_offer_to_answer_seconds",
+			Help:    "Time from a sender's offer to the collector's answer.",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800},
+		}),
+		lookupsRejected: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_lookups_rejected_total",
+			Help: "Phrase lookups refused by rate limiting or lockout.",
+		}),
+		lookupMisses: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_lookup_misses_total",
+			Help: "Phrase lookups for phrases which do not exist.",
+		}),
+		authFailures: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_auth_failures_total",
+			Help: "Websocket requests rejected by access control.",
+		}),
+		sessionsInvalidated: factory.NewCounter(prometheus.CounterOpts{
+			Name: "adit_sessions_invalidated_total",
+			Help: "Sessions invalidated after too many failed lookups sharing their nameplate and first word.",
+		}),
+	}
+}
+
+var knownMessageTypes = map[string]bool{
+	protocol.TypePing:             true,
+	protocol.TypePong:             true,
+	protocol.TypeOffer:            true,
+	protocol.TypeAnswer:           true,
+	protocol.TypeGetOffer:         true,
+	protocol.TypePhraseCreate:     true,
+	protocol.TypeICECandidate:     true,
+	protocol.TypeResume:           true,
+	protocol.TypeError:            true,
+	protocol.TypePeerDisconnected: true,
+}
+
+// messageTypeLabel keeps the cardinality of the type label bounded when
+// clients send message types the relay does not know
+func messageTypeLabel(messageType string) string {
+	if knownMessageTypes[messageType] {
+		return messageType
+	}
+	return "unknown"
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageTypeLabel(t *testing.T) {
+	types := []string{
+		protocol.TypePing, protocol.TypePong, protocol.TypeOffer, protocol.TypeAnswer,
+		protocol.TypeGetOffer, protocol.TypePhraseCreate, protocol.TypeICECandidate,
+		protocol.TypeResume, protocol.TypeError, protocol.TypePeerDisconnected,
+	}
+	for _, messageType := range types {
+		assert.Equal(t, messageType, messageTypeLabel(messageType))
+	}
+	assert.Equal(t, "unknown", messageTypeLabel("made up"))
+}
+
+func TestSessionCompletedOnFirstAnswer(t *testing.T) {
+	r := newTestRelay(t)
+	sender, senderClient := newTestPeer(t, r)
+	created, _ := startSession(t, sender, senderClient)
+
+	collector, collectorClient := newTestPeer(t, r)
+	handle(t, collector, collectorClient, hello())
+	offer := handle(t, collector, collectorClient, &protocol.Message{MessageType: protocol.TypeGetOffer, Phrase: created.Phrase})
+	require.Equal(t, protocol.TypeOffer, offer.MessageType)
+	answer, err := json.Marshal(&protocol.Message{MessageType: protocol.TypeAnswer, Phrase: created.Phrase, Content: testOfferSdp})
+	require.NoError(t, err)
+	collector.handleTextMessage(answer)
+	collector.handleTextMessage(answer)
+
+	// a peer which is not the collector is refused before the session
+	outsider, outsiderClient := newTestPeer(t, r)
+	handle(t, outsider, outsiderClient, hello())
+	outsider.handleTextMessage(answer)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(r.metrics.sessionsCompleted))
+	m := &dto.Metric{}
+	require.NoError(t, r.metrics.offerToAnswer.Write(m))
+	assert.Equal(t, uint64(1), m.GetHistogram().GetSampleCount())
+}
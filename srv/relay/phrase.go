@@ -0,0 +1,237 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Ryan-Har/adit/protocol"
+)
+
+const (
+	minChosenPhraseLength = 3
+	maxChosenPhraseLength = 64
+)
+
+// wordlist is the sorted words phrases are generated from
+type wordlist []string
+
+// newWordlist lowercases and sorts words, dropping duplicates and any
+// containing a separator. protocol.Wordlist() is used when words is nil.
+func newWordlist(words []string) wordlist {
+	if words == nil {
+		return protocol.Wordlist()
+	}
+	var w wordlist
+	for _, word := range words {
+		word = strings.ToLower(strings.TrimSpace(word))
+		if word != "" && strings.IndexFunc(word, protocol.IsPhraseSeparator) == -1 {
+			w = append(w, word)
+		}
+	}
+	slices.Sort(w)
+	return slices.Compact(w)
+}
+
+func (w wordlist) contains(word string) bool {
+	_, ok := slices.BinarySearch(w, word)
+	return ok
+}
+
+// bitsPerWord is the entropy of one word picked at random from the wordlist
+func (w wordlist) bitsPerWord() float64 {
+	return math.Log2(float64(len(w)))
+}
+
+// generatedPhraseEntropy is the entropy of a generated phrase of n words,
+// the nameplate is not counted as it is chosen to be short
+func (w wordlist) generatedPhraseEntropy(n int) float64 {
+	return float64(n) * w.bitsPerWord()
+}
+
+// errNoNameplate is returned when every nameplate tried was in use
+var errNoNameplate = errors.New("unable to find a free nameplate")
+
+// generatePhrase returns a phrase of a nameplate and n random words, such as
+// 7-chosen-murmuring. The nameplate is a number not used by any live
+// session, kept short by drawing it from a range which grows with the
+// number of sessions. Another relay may take the nameplate before the
+// session is created, which the store's Create then refuses.
+func (r *Relay) generatePhrase(ctx context.Context, n int) (string, error) {
+	count, err := r.store.Count(ctx)
+	if err != nil {
+		return "", err
+	}
+	upper := 9
+	for upper < 4*(count+1) {
+		upper = upper*10 + 9
+	}
+
+	for range maxPhraseAttempts {
+		nameplate := strconv.Itoa(rand.Intn(upper) + 1)
+		inUse, err := r.store.PhrasesWithPrefix(ctx, nameplate)
+		if err != nil {
+			return "", err
+		}
+		if len(inUse) > 0 {
+			continue
+		}
+
+		parts := []string{nameplate}
+		for range n {
+			parts = append(parts, r.words[rand.Intn(len(r.words))])
+		}
+		return strings.Join(parts, protocol.PhraseSeparator), nil
+	}
+	return "", errNoNameplate
+}
+
+// phraseEntropy estimates how hard a phrase chosen by a sender is to guess.
+// It is split into parts at separators and each distinct part counts as
+// a word from the wordlist at most, as a sender is likely to choose words,
+// except for runs of digits which count for each digit. The estimate errs
+// low, a chosen phrase is never credited more than one generated of the same
+// number of parts.
+func (w wordlist) phraseEntropy(phrase string) float64 {
+	seen := make(map[string]bool)
+	var bits float64
+	for _, part := range strings.FieldsFunc(phrase, protocol.IsPhraseSeparator) {
+		if seen[part] {
+			continue
+		}
+		seen[part] = true
+
+		if isNumber(part) {
+			bits += float64(len(part)) * math.Log2(10)
+			continue
+		}
+		if w.contains(part) {
+			bits += w.bitsPerWord()
+			continue
+		}
+		bits += min(float64(len(part))*math.Log2(36), w.bitsPerWord())
+	}
+	return bits
+}
+
+// checkChosenPhrase returns why a phrase requested by a sender is not
+// allowed, the phrase must already be normalised
+func (w wordlist) checkChosenPhrase(phrase string, minEntropy float64) error {
+	if len(phrase) < minChosenPhraseLength || len(phrase) > maxChosenPhraseLength {
+		return fmt.Errorf("phrase must be between %d and %d characters", minChosenPhraseLength, maxChosenPhraseLength)
+	}
+	for _, r := range phrase {
+		if !protocol.IsPhraseSeparator(r) && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return fmt.Errorf("phrase may only contain letters, digits and the separators . - _, not %q", r)
+		}
+	}
+	if bits := w.phraseEntropy(phrase); bits < minEntropy {
+		return fmt.Errorf("phrase is too easy to guess, it has an estimated %.0f bits of entropy and at least %.0f are required, add more words or digits", bits, minEntropy)
+	}
+	return nil
+}
+
+// checkPhraseWords returns why a sender may not request a generated phrase
+// of n words
+func (w wordlist) checkPhraseWords(n int, minEntropy float64) error {
+	if n < MinPhraseLength || n > MaxPhraseLength {
+		return fmt.Errorf("phrase must be between %d and %d words", MinPhraseLength, MaxPhraseLength)
+	}
+	if bits := w.generatedPhraseEntropy(n); bits < minEntropy {
+		return fmt.Errorf("a phrase of %d words has %.0f bits of entropy and at least %.0f are required", n, bits, minEntropy)
+	}
+	return nil
+}
+
+// maxSuggestionDistance is the most edits a word may be from a word in the
+// wordlist to be corrected
+const maxSuggestionDistance = 2
+
+// suggestPhrase corrects the words of a phrase which are not in the wordlist
+// to the closest word which is, such as 7-chosen-murmering to
+// 7-chosen-murmuring. Only the wordlist is consulted, never the live
+// sessions, so a suggestion tells a guesser nothing. An empty string is
+// returned when there is nothing to correct or a word is too far from any
+// in the wordlist.
+func (w wordlist) suggestPhrase(phrase string) string {
+	parts := strings.FieldsFunc(protocol.NormalisePhrase(phrase), protocol.IsPhraseSeparator)
+	if len(parts) < 2 {
+		return ""
+	}
+	for i, part := range parts {
+		if isNumber(part) || w.contains(part) {
+			continue
+		}
+		word, ok := w.closestWord(part)
+		if !ok {
+			return ""
+		}
+		parts[i] = word
+	}
+
+	suggestion := strings.Join(parts, protocol.PhraseSeparator)
+	if suggestion == phrase {
+		return ""
+	}
+	return suggestion
+}
+
+func isNumber(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) == -1
+}
+
+// closestWord returns the word in the wordlist fewest edits from s, the
+// first in the list wins a tie
+func (w wordlist) closestWord(s string) (string, bool) {
+	best, bestDistance := "", maxSuggestionDistance+1
+	for _, word := range w {
+		if abs(len(word)-len(s)) >= bestDistance {
+			continue
+		}
+		if d := editDistance(s, word); d < bestDistance {
+			best, bestDistance = word, d
+		}
+	}
+	// a short word is within a couple of edits of far too many others
+	return best, best != "" && bestDistance < len(s)/2+1
+}
+
+// editDistance is the optimal string alignment distance between a and b,
+// counting insertions, deletions, substitutions and swapping adjacent
+// letters as one edit each
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
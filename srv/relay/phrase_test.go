@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckChosenPhrase(t *testing.T) {
+	tests := map[string]bool{
+		"acme-invoices-2024":        true,
+		"correct.horse.battery":     true,
+		"zebra_zoo_777_1234":        true,
+		"project-42":                false,
+		"password":                  false,
+		"apple.apple.apple.apple":   false,
+		"ab.cd":                     false,
+		"has space.in.it.somewhere": false,
+		"ab":                        false,
+		strings.Repeat("a.", 40):    false,
+	}
+
+	for phrase, allowed := range tests {
+		t.Run(phrase, func(t *testing.T) {
+			err := newWordlist(nil).checkChosenPhrase(phrase, 32)
+			if allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckPhraseWords(t *testing.T) {
+	words := newWordlist(nil)
+	assert.NoError(t, words.checkPhraseWords(3, 32))
+	assert.Error(t, words.checkPhraseWords(3, 40))
+	assert.Error(t, words.checkPhraseWords(2, 0))
+	assert.Error(t, words.checkPhraseWords(MaxPhraseLength+1, 0))
+}
+
+func TestOfferWithChosenPhrase(t *testing.T) {
+	r := newTestRelay(t)
+	p, client := newTestPeer(t, r)
+	handle(t, p, client, hello())
+
+	reply := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: &protocol.Offer{SDP: testOfferSdp, Phrase: "project-42"}})
+	assert.Equal(t, protocol.CodePhraseRejected, reply.ToError().Code)
+
+	reply = handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: &protocol.Offer{SDP: testOfferSdp, Phrase: " Acme-Invoices-2024 "}})
+	require.Equal(t, protocol.TypePhraseCreate, reply.MessageType)
+	assert.Equal(t, "acme-invoices-2024", reply.Phrase)
+
+	other, otherClient := newTestPeer(t, r)
+	handle(t, other, otherClient, hello())
+	reply = handle(t, other, otherClient, &protocol.Message{MessageType: protocol.TypeOffer, Content: &protocol.Offer{SDP: testOfferSdp, Phrase: "acme-invoices-2024"}})
+	assert.Equal(t, protocol.CodePhraseInUse, reply.ToError().Code)
+}
+
+func TestOfferWithWordCount(t *testing.T) {
+	r := newTestRelay(t)
+	p, client := newTestPeer(t, r)
+	handle(t, p, client, hello())
+
+	reply := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: &protocol.Offer{SDP: testOfferSdp, Words: 1}})
+	assert.Equal(t, protocol.CodePhraseRejected, reply.ToError().Code)
+
+	reply = handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: &protocol.Offer{SDP: testOfferSdp, Words: 8}})
+	require.Equal(t, protocol.TypePhraseCreate, reply.MessageType)
+	assert.Len(t, strings.Split(reply.Phrase, "-"), 9, "eight words after the nameplate")
+}
+
+func TestGeneratePhrase(t *testing.T) {
+	r := newTestRelay(t)
+	ctx := context.Background()
+	// every single digit nameplate but one is taken
+	for n := 1; n <= 9; n++ {
+		if n != 4 {
+			require.NoError(t, r.store.Create(ctx, &Session{Phrase: strconv.Itoa(n) + "-apple-banana"}))
+		}
+	}
+
+	phrase, err := r.generatePhrase(ctx, 3)
+	require.NoError(t, err)
+	parts := strings.Split(phrase, "-")
+	require.Len(t, parts, 4)
+	nameplate, err := strconv.Atoi(parts[0])
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, nameplate, 1)
+	assert.LessOrEqual(t, nameplate, 99, "the range should grow with the number of sessions")
+	assert.NotEqual(t, 1, nameplate)
+	for _, word := range parts[1:] {
+		assert.True(t, protocol.IsWord(word), word)
+	}
+}
+
+func TestSuggestPhrase(t *testing.T) {
+	tests := map[string]string{
+		"7-chosen-murmering": "7-chosen-murmuring",
+		"7-chosne-murmuring": "7-chosen-murmuring",
+		"7 chosen murmuring": "7-chosen-murmuring",
+		"7.chosen.murmuring": "7-chosen-murmuring",
+		"7-chosen-murmuring": "",
+		"7-chosen-xqzvbnmw":  "",
+		"murmuring":          "",
+		"acme-invoices-2024": "",
+	}
+
+	for phrase, want := range tests {
+		t.Run(phrase, func(t *testing.T) {
+			assert.Equal(t, want, newWordlist(nil).suggestPhrase(phrase))
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("chosen", "chosen"))
+	assert.Equal(t, 1, editDistance("chosne", "chosen"), "swapped letters are one edit")
+	assert.Equal(t, 1, editDistance("murmering", "murmuring"))
+	assert.Equal(t, 2, editDistance("chsn", "chosen"))
+	assert.Equal(t, 3, editDistance("", "abc"))
+}
+
+func TestLookupSuggestsCorrection(t *testing.T) {
+	r := newTestRelay(t)
+	p, client := newTestPeer(t, r)
+	handle(t, p, client, hello())
+
+	reply := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeGetOffer, Phrase: "7-chosen-murmering"})
+	e := reply.ToError()
+	assert.Equal(t, protocol.CodePhraseNotFound, e.Code)
+	assert.Equal(t, "7-chosen-murmuring", e.Suggestion)
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LookupLimits configures the protection of "get offer" against phrases
+// being guessed
+type LookupLimits struct {
+	// Rate is the sustained number of lookups per second allowed for each ip
+	// address and each connection, with bursts of up to Burst
+	Rate  float64
+	Burst int
+	// MissesBeforeLockout lookups of phrases which do not exist are allowed
+	// before lookups are refused for BaseLockout. Each further miss doubles
+	// the lockout, up to MaxLockout. A connection's misses are forgotten
+	// once it finds its phrase, an address's only once it has made no
+	// lookups for MaxLockout.
+	MissesBeforeLockout int
+	BaseLockout         time.Duration
+	MaxLockout          time.Duration
+	// MaxPrefixFailures is the number of failed lookups sharing the
+	// nameplate and first word of a live phrase after which that session is
+	// invalidated
+	MaxPrefixFailures int
+	// TrustProxy takes the client address from the last entry of
+	// X-Forwarded-For, only enable it when the relay is behind a single load
+	// balancer which appends the address it received the request from
+	TrustProxy bool
+}
+
+// attemptLimiter is a token bucket with an exponential lockout after
+// repeated misses
+type attemptLimiter struct {
+	tokens      float64
+	last        time.Time
+	misses      int
+	lockedUntil time.Time
+}
+
+// allow takes a token if one is available, otherwise it returns how long
+// to wait before trying again
+func (a *attemptLimiter) allow(now time.Time, limits LookupLimits) (bool, time.Duration) {
+	if now.Before(a.lockedUntil) {
+		return false, a.lockedUntil.Sub(now)
+	}
+
+	if a.last.IsZero() {
+		a.tokens = float64(limits.Burst)
+	} else {
+		a.tokens = math.Min(float64(limits.Burst), a.tokens+now.Sub(a.last).Seconds()*limits.Rate)
+	}
+	a.last = now
+
+	if a.tokens < 1 {
+		return false, time.Duration((1 - a.tokens) / limits.Rate * float64(time.Second))
+	}
+	a.tokens--
+	return true, 0
+}
+
+func (a *attemptLimiter) miss(now time.Time, limits LookupLimits) {
+	a.misses++
+	if a.misses < limits.MissesBeforeLockout {
+		return
+	}
+
+	lockout := limits.BaseLockout
+	for i := limits.MissesBeforeLockout; i < a.misses && lockout < limits.MaxLockout; i++ {
+		lockout *= 2
+	}
+	a.lockedUntil = now.Add(min(lockout, limits.MaxLockout))
+}
+
+func (a *attemptLimiter) hit() {
+	a.misses = 0
+}
+
+// idle reports whether the limiter is back in its initial state and can be
+// discarded
+func (a *attemptLimiter) idle(now time.Time, limits LookupLimits) bool {
+	return now.After(a.lockedUntil) && now.Sub(a.last) > limits.MaxLockout
+}
+
+// ipLimiters holds an attemptLimiter for each client address
+type ipLimiters struct {
+	limits   LookupLimits
+	mu       sync.Mutex
+	limiters map[string]*attemptLimiter
+}
+
+func newIPLimiters(limits LookupLimits) *ipLimiters {
+	return &ipLimiters{limits: limits, limiters: make(map[string]*attemptLimiter)}
+}
+
+func (l *ipLimiters) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.get(ip).allow(now, l.limits)
+}
+
+func (l *ipLimiters) miss(ip string, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.get(ip).miss(now, l.limits)
+}
+
+func (l *ipLimiters) get(ip string) *attemptLimiter {
+	a, ok := l.limiters[ip]
+	if !ok {
+		a = &attemptLimiter{}
+		l.limiters[ip] = a
+	}
+	return a
+}
+
+// pruneEvery removes idle limiters so that the map does not grow forever,
+// until ctx is done
+func (l *ipLimiters) pruneEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return
+		case now = <-ticker.C:
+		}
+		l.mu.Lock()
+		for ip, a := range l.limiters {
+			if a.idle(now, l.limits) {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// clientIP returns the address of the client which made the request. Behind
+// a proxy it is the last address in X-Forwarded-For, the one the proxy
+// appended, as the client can put anything before it.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		// the header may be split over several lines, the last is the proxy's
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			last := forwarded[len(forwarded)-1]
+			if i := strings.LastIndex(last, ","); i != -1 {
+				last = last[i+1:]
+			}
+			if last = strings.TrimSpace(last); last != "" {
+				return last
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,231 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testLimits = LookupLimits{
+	Rate:                1,
+	Burst:               2,
+	MissesBeforeLockout: 2,
+	BaseLockout:         time.Second,
+	MaxLockout:          4 * time.Second,
+	MaxPrefixFailures:   3,
+}
+
+func TestAttemptLimiterBurstAndRefill(t *testing.T) {
+	var a attemptLimiter
+	now := time.Now()
+
+	ok, _ := a.allow(now, testLimits)
+	assert.True(t, ok)
+	ok, _ = a.allow(now, testLimits)
+	assert.True(t, ok)
+
+	ok, wait := a.allow(now, testLimits)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	ok, _ = a.allow(now.Add(time.Second), testLimits)
+	assert.True(t, ok)
+}
+
+func TestAttemptLimiterExponentialLockout(t *testing.T) {
+	var a attemptLimiter
+	now := time.Now()
+
+	a.miss(now, testLimits)
+	assert.True(t, a.lockedUntil.IsZero(), "first miss should not lock out")
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	for _, lockout := range expected {
+		a.miss(now, testLimits)
+		assert.Equal(t, now.Add(lockout), a.lockedUntil)
+	}
+
+	ok, wait := a.allow(now.Add(time.Second), testLimits)
+	assert.False(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+
+	a.hit()
+	assert.Equal(t, 0, a.misses)
+}
+
+func TestRecordLookupMissInvalidatesSession(t *testing.T) {
+	r := newTestRelay(t, func(o *Options) { o.Limits.Lookups = testLimits })
+
+	ctx := context.Background()
+	require.NoError(t, r.store.Create(ctx, &Session{Phrase: "apple.banana"}))
+	require.NoError(t, r.store.Create(ctx, &Session{Phrase: "cherry.banana"}))
+
+	var received []*protocol.Message
+	_, err := r.store.Subscribe(ctx, "apple.banana", RoleSender, func(m *protocol.Message) {
+		received = append(received, m)
+	})
+	require.NoError(t, err)
+
+	p := &peer{relay: r, RemoteIP: "192.0.2.1"}
+	for range testLimits.MaxPrefixFailures - 1 {
+		p.recordLookupMiss(ctx, "apple.wrong")
+	}
+	_, err = r.store.Get(ctx, "apple.banana")
+	assert.NoError(t, err)
+
+	p.recordLookupMiss(ctx, "apple.wrong")
+	_, err = r.store.Get(ctx, "apple.banana")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	if assert.Len(t, received, 1) {
+		assert.Equal(t, protocol.CodeSessionInvalidated, received[0].ToError().Code)
+	}
+
+	cherry, err := r.store.Get(ctx, "cherry.banana")
+	require.NoError(t, err)
+	assert.Equal(t, 0, cherry.FailedLookups)
+}
+
+func TestClientIP(t *testing.T) {
+	tests := map[string]struct {
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		"remote address":         {nil, false, "192.0.2.1"},
+		"proxy not trusted":      {[]string{"203.0.113.7"}, false, "192.0.2.1"},
+		"no header":              {nil, true, "192.0.2.1"},
+		"appended by proxy":      {[]string{"203.0.113.7"}, true, "203.0.113.7"},
+		"spoofed leading values": {[]string{"198.51.100.1, 198.51.100.2,203.0.113.7"}, true, "203.0.113.7"},
+		"several header lines":   {[]string{"198.51.100.1", "203.0.113.7"}, true, "203.0.113.7"},
+		"empty last entry":       {[]string{"198.51.100.1,"}, true, "192.0.2.1"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.RemoteAddr = "192.0.2.1:4321"
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			assert.Equal(t, tt.want, clientIP(r, tt.trustProxy))
+		})
+	}
+}
+
+func TestSpoofedForwardedForIsLockedOut(t *testing.T) {
+	limits := testLimits
+	// only the lockout can refuse a lookup
+	limits.Rate, limits.Burst = 100, 100
+	r := newTestRelay(t, func(o *Options) {
+		o.Limits.Lookups = limits
+		o.Limits.Lookups.TrustProxy = true
+	})
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	// each lookup is made on a new connection with a different address put
+	// in front of the one the proxy appended
+	lookup := func(i int) *protocol.Message {
+		header := http.Header{}
+		header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d, 203.0.113.7", i))
+		client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", header)
+		require.NoError(t, err)
+		defer client.Close()
+
+		reply := &protocol.Message{}
+		require.NoError(t, client.WriteJSON(hello()))
+		require.NoError(t, client.ReadJSON(reply))
+		require.NoError(t, client.WriteJSON(&protocol.Message{MessageType: protocol.TypeGetOffer, Phrase: "9-wrong-guess"}))
+		require.NoError(t, client.ReadJSON(reply))
+		return reply
+	}
+
+	for i := range limits.MissesBeforeLockout {
+		assert.Equal(t, protocol.CodePhraseNotFound, lookup(i).ToError().Code)
+	}
+	assert.Equal(t, protocol.CodeRateLimited, lookup(limits.MissesBeforeLockout).ToError().Code,
+		"a new leading address should not escape the lockout")
+}
+
+func TestLookupHitsDoNotResetAddressLockout(t *testing.T) {
+	limits := testLimits
+	limits.Rate, limits.Burst = 100, 100
+	limits.MissesBeforeLockout = 3
+	r := newTestRelay(t, func(o *Options) { o.Limits.Lookups = limits })
+	ctx := context.Background()
+	require.NoError(t, r.store.Create(ctx, &Session{Phrase: "1-open-phrase", SenderConnected: true, OfferSdp: testOfferSdp}))
+	require.NoError(t, r.store.Create(ctx, &Session{Phrase: "2-claimed-phrase", CollectorClaimed: true}))
+
+	// every lookup is from a new connection at the same address
+	lookup := func(phrase string) string {
+		p, client := newTestPeer(t, r)
+		p.RemoteIP = "192.0.2.1"
+		handle(t, p, client, hello())
+		reply := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeGetOffer, Phrase: phrase})
+		if reply.MessageType != protocol.TypeError {
+			return reply.MessageType
+		}
+		return reply.ToError().Code
+	}
+
+	assert.Equal(t, protocol.CodePhraseNotFound, lookup("9-wrong-guess"))
+	assert.Equal(t, protocol.TypeOffer, lookup("1-open-phrase"))
+	assert.Equal(t, protocol.CodePhraseNotFound, lookup("9-wrong-guess"))
+	assert.Equal(t, protocol.CodePhraseClaimed, lookup("2-claimed-phrase"))
+	assert.Equal(t, protocol.CodePhraseNotFound, lookup("9-wrong-guess"))
+	assert.Equal(t, protocol.CodeRateLimited, lookup("9-wrong-guess"), "finding phrases should not reset the lockout")
+}
+
+func TestLookupPrefix(t *testing.T) {
+	tests := map[string]string{
+		"7-chosen-murmuring": "7-chosen",
+		"42.chosen":          "42.chosen",
+		"7":                  "7",
+		"apple.banana":       "apple",
+		"acme-invoices-2024": "acme",
+		"2024-acme-invoices": "2024-acme",
+	}
+	for phrase, want := range tests {
+		assert.Equal(t, want, lookupPrefix(phrase), phrase)
+	}
+}
+
+func TestMissesOnNameplateOnlyLeaveSessionsAlone(t *testing.T) {
+	r := newTestRelay(t, func(o *Options) { o.Limits.Lookups = testLimits })
+	ctx := context.Background()
+	live := []string{"1-chosen-murmuring", "2-hardwood-chop", "3-chosen-germproof"}
+	for _, phrase := range live {
+		require.NoError(t, r.store.Create(ctx, &Session{Phrase: phrase}))
+	}
+
+	// guessing the nameplates alone would reach every session, as generated
+	// nameplates start at 1
+	p := &peer{relay: r, RemoteIP: "192.0.2.1"}
+	for nameplate := 1; nameplate <= 9; nameplate++ {
+		for range testLimits.MaxPrefixFailures {
+			p.recordLookupMiss(ctx, fmt.Sprintf("%d-wrong-guess", nameplate))
+		}
+	}
+	for _, phrase := range live {
+		_, err := r.store.Get(ctx, phrase)
+		assert.NoError(t, err, "%s should survive misses which only share its nameplate", phrase)
+	}
+
+	for range testLimits.MaxPrefixFailures {
+		p.recordLookupMiss(ctx, "1-chosen-wrong")
+	}
+	_, err := r.store.Get(ctx, "1-chosen-murmuring")
+	assert.ErrorIs(t, err, ErrSessionNotFound, "misses sharing the nameplate and first word count against the session")
+	for _, phrase := range live[1:] {
+		_, err := r.store.Get(ctx, phrase)
+		assert.NoError(t, err, "%s is unrelated to the misses", phrase)
+	}
+}
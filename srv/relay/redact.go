@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/Ryan-Har/adit/protocol"
+)
+
+// sessionID identifies a session in the logs without the phrase, which would
+// let anyone reading them collect the file. The hash is keyed so phrases
+// cannot be found by hashing guesses, which means IDs only match within one
+// relay process.
+func (r *Relay) sessionID(phrase string) string {
+	if phrase == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, r.logKey)
+	mac.Write([]byte(phrase))
+	return hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// redacted returns a copy of m to log with the phrase replaced by its
+// session ID and any content which could be used to join or take over the
+// session hidden, such as the resume token, the phrase and the SDP
+func (r *Relay) redacted(m *protocol.Message) *protocol.Message {
+	c := *m
+	c.Phrase = r.sessionID(m.Phrase)
+	switch m.MessageType {
+	case protocol.TypePing, protocol.TypePong, protocol.TypePeerDisconnected:
+	case protocol.TypeError:
+		if e, ok := m.Content.(*protocol.Error); ok && e.Suggestion != "" {
+			redactedErr := *e
+			redactedErr.Message = strings.ReplaceAll(e.Message, e.Suggestion, "[redacted]")
+			redactedErr.Suggestion = "[redacted]"
+			c.Content = &redactedErr
+		}
+	default:
+		if m.Content != nil {
+			c.Content = "[redacted]"
+		}
+	}
+	return &c
+}
@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPhraseAndSDPAreNotLogged(t *testing.T) {
+	var logs lockedBuffer
+	r := newTestRelay(t, func(o *Options) {
+		o.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	})
+	sender, senderClient := newTestPeer(t, r)
+	created, _ := startSession(t, sender, senderClient)
+
+	collector, collectorClient := newTestPeer(t, r)
+	handle(t, collector, collectorClient, hello())
+	offer := handle(t, collector, collectorClient, &protocol.Message{MessageType: protocol.TypeGetOffer, Phrase: created.Phrase})
+	require.Equal(t, protocol.TypeOffer, offer.MessageType)
+	answer, err := json.Marshal(&protocol.Message{MessageType: protocol.TypeAnswer, Phrase: created.Phrase, Content: testOfferSdp})
+	require.NoError(t, err)
+	collector.handleTextMessage(answer)
+	handle(t, collector, collectorClient, &protocol.Message{MessageType: protocol.TypeICECandidate, Phrase: created.Phrase, Content: testCandidate})
+
+	assert.Contains(t, logs.String(), r.sessionID(created.Phrase), "sessions should be identifiable in the logs")
+	assert.NotContains(t, logs.String(), created.Phrase, "the phrase should not be logged")
+	assert.NotContains(t, logs.String(), "sctp-port", "the SDP should not be logged")
+	assert.NotContains(t, logs.String(), testCandidate, "the candidates should not be logged")
+}
+
+func TestRedactedHidesSuggestion(t *testing.T) {
+	r := newTestRelay(t)
+	m := &protocol.Message{MessageType: protocol.TypeError, Content: &protocol.Error{
+		Code:       protocol.CodePhraseNotFound,
+		Message:    "phrase does not exist, did you mean 7-chosen-murmuring?",
+		Suggestion: "7-chosen-murmuring",
+	}}
+
+	e := r.redacted(m).Content.(*protocol.Error)
+	assert.Equal(t, "phrase does not exist, did you mean [redacted]?", e.Message)
+	assert.Equal(t, "[redacted]", e.Suggestion)
+	assert.Equal(t, "7-chosen-murmuring", m.Content.(*protocol.Error).Suggestion, "the message sent should be unchanged")
+}
+
+func TestSessionIDIsKeyed(t *testing.T) {
+	r, other := newTestRelay(t), newTestRelay(t)
+	assert.Equal(t, r.sessionID("7-chosen-murmuring"), r.sessionID("7-chosen-murmuring"))
+	assert.NotEqual(t, r.sessionID("7-chosen-murmuring"), r.sessionID("8-chosen-murmuring"))
+	assert.NotEqual(t, r.sessionID("7-chosen-murmuring"), other.sessionID("7-chosen-murmuring"), "each relay has its own key")
+	assert.Empty(t, r.sessionID(""))
+}
@@ -0,0 +1,350 @@
+// Package relay is the adit signaling server. It pairs a sender with the
+// collector holding its phrase and passes their WebRTC offer, answer and ICE
+// candidates between them, after which the file is sent directly between
+// the peers.
+//
+// A Relay is an http.Handler serving the websocket at /ws and a health check
+// at /health, so it can be mounted in an existing server or started with
+// httptest:
+//
+//	r, err := relay.New(relay.DefaultOptions())
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	server := httptest.NewServer(r)
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	MinPhraseLength = 3
+	MaxPhraseLength = 16
+	// MinMessageSize leaves room for an SDP offer with a few candidates
+	MinMessageSize = 4096
+)
+
+// Options configures a Relay, start from DefaultOptions
+type Options struct {
+	// Store holds the sessions, a new in-memory store is used when nil. A
+	// store shared with other relays, such as one from NewRedisStore, lets
+	// the sender and collector connect to different instances. The relay
+	// does not close it.
+	Store SessionStore
+	// Wordlist is the words phrases are generated from, protocol.Wordlist()
+	// when nil. Collectors only get completions and suggestions for words
+	// in protocol.Wordlist().
+	Wordlist []string
+	// Logger receives the relay's logs, slog.Default() is used when nil
+	Logger *slog.Logger
+	// Registerer is where the relay's Prometheus metrics are registered,
+	// they are not registered when it is nil
+	Registerer prometheus.Registerer
+
+	Limits Limits
+	Auth   Auth
+	// AllowedOrigins restricts the Origin header of websocket requests,
+	// requests without the header, such as those from the CLI, are allowed
+	AllowedOrigins []string
+
+	// PhraseLength is the number of words in a generated phrase
+	PhraseLength int
+	// MinPhraseEntropy is the estimated entropy in bits a phrase chosen by a
+	// sender must have, generated phrases must also meet it
+	MinPhraseEntropy float64
+	// SessionTTL is how long a session may wait to be paired
+	SessionTTL time.Duration
+	// ResumeGrace is how long a session is held for a sender which lost its
+	// connection to resume it, resuming is disabled when it is zero
+	ResumeGrace time.Duration
+}
+
+// Limits bounds what each client may send
+type Limits struct {
+	// MaxMessageSize and ReadTimeout bound each websocket message, a client
+	// which sends nothing, not even a pong, for ReadTimeout is disconnected
+	MaxMessageSize int64
+	ReadTimeout    time.Duration
+	// PingInterval is how often websocket pings are sent to each client, it
+	// must be shorter than ReadTimeout
+	PingInterval time.Duration
+	// MaxCandidates is how many ICE candidates each peer may send in a session
+	MaxCandidates int
+	Lookups       LookupLimits
+}
+
+// DefaultOptions returns the options adit-srv runs with when nothing is
+// configured
+func DefaultOptions() Options {
+	return Options{
+		PhraseLength:     5,
+		MinPhraseEntropy: 32,
+		SessionTTL:       10 * time.Minute,
+		ResumeGrace:      30 * time.Second,
+		Limits: Limits{
+			MaxMessageSize: 64 * 1024,
+			ReadTimeout:    time.Minute,
+			PingInterval:   20 * time.Second,
+			MaxCandidates:  50,
+			// every collector behind a shared NAT address uses its limits,
+			// guessing is held back by the lockout on misses rather than
+			// the rate
+			Lookups: LookupLimits{
+				Rate:                2,
+				Burst:               30,
+				MissesBeforeLockout: 5,
+				BaseLockout:         5 * time.Second,
+				MaxLockout:          10 * time.Minute,
+				MaxPrefixFailures:   10,
+			},
+		},
+	}
+}
+
+// Validate returns every problem with the options
+func (o Options) Validate() error {
+	var errs []error
+
+	for _, origin := range o.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("allowed origin %q must be a scheme and host such as https://example.com", origin))
+		}
+	}
+	if o.Auth.HMACSecret != "" && len(o.Auth.HMACSecret) < MinHMACSecretLength {
+		errs = append(errs, fmt.Errorf("the HMAC secret must be at least %d characters", MinHMACSecretLength))
+	}
+
+	if o.SessionTTL <= 0 {
+		errs = append(errs, errors.New("the session TTL must be greater than zero"))
+	}
+	if o.ResumeGrace < 0 {
+		errs = append(errs, errors.New("the resume grace period cannot be negative"))
+	}
+	if o.Limits.MaxMessageSize < MinMessageSize {
+		errs = append(errs, fmt.Errorf("the maximum message size must be at least %d bytes", MinMessageSize))
+	}
+	if o.Limits.ReadTimeout <= 0 {
+		errs = append(errs, errors.New("the read timeout must be greater than zero"))
+	}
+	if o.Limits.PingInterval <= 0 || o.Limits.PingInterval >= o.Limits.ReadTimeout {
+		errs = append(errs, errors.New("the ping interval must be greater than zero and shorter than the read timeout"))
+	}
+	if o.Limits.MaxCandidates <= 0 {
+		errs = append(errs, errors.New("the maximum number of candidates must be greater than zero"))
+	}
+	if l := o.Limits.Lookups; l.Rate <= 0 || l.Burst <= 0 || l.MissesBeforeLockout <= 0 || l.MaxPrefixFailures <= 0 {
+		errs = append(errs, errors.New("the lookup rate, burst, misses before lockout and prefix failures must be greater than zero"))
+	}
+	if l := o.Limits.Lookups; l.BaseLockout <= 0 || l.MaxLockout < l.BaseLockout {
+		errs = append(errs, errors.New("the base lockout must be greater than zero and no longer than the maximum lockout"))
+	}
+
+	words := newWordlist(o.Wordlist)
+	if o.Wordlist != nil && len(words) < 2 {
+		errs = append(errs, errors.New("the wordlist must have at least two words without separators"))
+	}
+	if o.PhraseLength < MinPhraseLength || o.PhraseLength > MaxPhraseLength {
+		errs = append(errs, fmt.Errorf("the phrase length must be between %d and %d words", MinPhraseLength, MaxPhraseLength))
+	}
+	if o.MinPhraseEntropy < 0 {
+		errs = append(errs, errors.New("the minimum phrase entropy cannot be negative"))
+	} else if bits := words.generatedPhraseEntropy(o.PhraseLength); bits < o.MinPhraseEntropy {
+		errs = append(errs, fmt.Errorf("generated phrases of %d words have %.0f bits of entropy, below the minimum phrase entropy", o.PhraseLength, bits))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Relay pairs senders and collectors, it must be closed once it is no
+// longer served
+type Relay struct {
+	opts     Options
+	store    SessionStore
+	words    wordlist
+	log      *slog.Logger
+	metrics  *metrics
+	upgrader websocket.Upgrader
+	mux      *http.ServeMux
+	limiters *ipLimiters
+	// logKey keys the hash which stands in for phrases in the logs
+	logKey []byte
+
+	// draining is set once Drain is called, new sessions are refused and
+	// /health reports the relay as unavailable
+	draining atomic.Bool
+	// peers tracks every open websocket so they can be closed, an
+	// http.Server does not close hijacked connections on shutdown
+	peersMu sync.Mutex
+	peers   map[*peer]struct{}
+
+	stop context.CancelFunc
+}
+
+// New returns a relay configured by opts, which starts expiring sessions
+// in the background until it is closed
+func New(opts Options) (*Relay, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Store == nil {
+		opts.Store = NewMemoryStore()
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	logKey := make([]byte, 32)
+	if _, err := rand.Read(logKey); err != nil {
+		return nil, fmt.Errorf("unable to generate log key: %w", err)
+	}
+
+	r := &Relay{
+		opts:     opts,
+		store:    opts.Store,
+		words:    newWordlist(opts.Wordlist),
+		log:      opts.Logger,
+		limiters: newIPLimiters(opts.Limits.Lookups),
+		logKey:   logKey,
+		peers:    make(map[*peer]struct{}),
+	}
+	r.metrics = newMetrics(opts.Registerer, r.liveSessions)
+	r.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(req *http.Request) bool {
+			return r.originAllowed(req.Header.Get("Origin"))
+		},
+	}
+	r.mux = http.NewServeMux()
+	r.mux.HandleFunc("/ws", r.wsUpgrade)
+	r.mux.HandleFunc("/health", r.healthCheck)
+
+	ctx, stop := context.WithCancel(context.Background())
+	r.stop = stop
+	go r.limiters.pruneEvery(ctx, time.Minute)
+	go r.expireSessionsEvery(ctx, time.Minute)
+	return r, nil
+}
+
+// ServeHTTP serves the websocket at /ws and the health check at /health
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.ServeHTTP(w, req)
+}
+
+// liveSessions counts the sessions in the store for the metrics
+func (r *Relay) liveSessions() float64 {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	n, err := r.store.Count(ctx)
+	if err != nil {
+		r.log.Error("unable to count sessions", "error", err)
+	}
+	return float64(n)
+}
+
+// expireSessionsEvery removes sessions older than the session TTL, telling any
+// peers still connected to them
+func (r *Relay) expireSessionsEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ctx, cancel := context.WithTimeout(ctx, storeTimeout)
+			r.expireSessions(ctx, now)
+			cancel()
+		}
+	}
+}
+
+// expireSessions checks the sessions of the peers connected to this instance,
+// so with a shared store each session is reaped by an instance hosting one of
+// its peers
+func (r *Relay) expireSessions(ctx context.Context, now time.Time) {
+	for _, phrase := range r.localPhrases() {
+		s, err := r.store.Get(ctx, phrase)
+		if err != nil || now.Sub(s.CreatedAt) < r.opts.SessionTTL {
+			continue
+		}
+		r.log.Info("session expired", "session", r.sessionID(phrase))
+		r.metrics.sessionsExpired.Inc()
+		if err := r.store.Delete(ctx, phrase); err != nil {
+			r.log.Error("unable to delete session", "session", r.sessionID(phrase), "error", err)
+		}
+		for _, role := range []Role{RoleSender, RoleCollector} {
+			r.publishError(ctx, phrase, role, protocol.CodeSessionExpired, "session expired before the transfer was set up")
+		}
+	}
+}
+
+func (r *Relay) wsUpgrade(w http.ResponseWriter, req *http.Request) {
+	if err := r.opts.Auth.authorize(req); err != nil {
+		r.log.Info("rejected unauthorized websocket request", "remoteAddr", req.RemoteAddr, "error", err)
+		r.metrics.authFailures.Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer realm="adit"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	conn, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		r.log.Error("websocket upgrade error", "error", err)
+		return
+	}
+	r.log.Info("new websocket connection", "remoteAddr", conn.RemoteAddr())
+	r.metrics.activeConnections.Inc()
+	conn.SetReadLimit(r.opts.Limits.MaxMessageSize)
+	//don't close here, handleConnection will close
+	p := &peer{
+		Conn:     conn,
+		relay:    r,
+		RemoteIP: clientIP(req, r.opts.Limits.Lookups.TrustProxy),
+	}
+	r.trackPeer(p)
+
+	go p.handleConnection()
+}
+
+func (r *Relay) healthCheck(w http.ResponseWriter, req *http.Request) {
+	if r.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("DRAINING"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// originAllowed reports whether a websocket request from origin is allowed
+func (r *Relay) originAllowed(origin string) bool {
+	if origin == "" || len(r.opts.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range r.opts.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
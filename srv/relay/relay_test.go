@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockedBuffer collects logs written from the relay's goroutines
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRelayServesSessions(t *testing.T) {
+	var logs lockedBuffer
+	words := make([]string, 0, 4096)
+	for _, w := range protocol.Wordlist()[:4096] {
+		words = append(words, strings.ToUpper(w))
+	}
+	r := newTestRelay(t, func(o *Options) {
+		o.Wordlist = words
+		o.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	})
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	reply := &protocol.Message{}
+	require.NoError(t, client.WriteJSON(hello()))
+	require.NoError(t, client.ReadJSON(reply))
+	require.NoError(t, client.WriteJSON(&protocol.Message{MessageType: protocol.TypeOffer, Content: testOfferSdp}))
+	require.NoError(t, client.ReadJSON(reply))
+	require.Equal(t, protocol.TypePhraseCreate, reply.MessageType)
+
+	parts := strings.Split(reply.Phrase, protocol.PhraseSeparator)
+	require.Len(t, parts, 6)
+	for _, word := range parts[1:] {
+		assert.True(t, r.words.contains(word), "%s should be from the relay's wordlist", word)
+	}
+	_, err = r.store.Get(context.Background(), reply.Phrase)
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), "new websocket connection", "logs should go to the given logger")
+}
+
+func TestRelayHealthReportsDraining(t *testing.T) {
+	r := newTestRelay(t)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	health := func() (int, string) {
+		resp, err := http.Get(server.URL + "/health")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := health()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "OK", body)
+
+	r.Drain(context.Background())
+	status, body = health()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "DRAINING", body)
+}
+
+func TestOptionsValidate(t *testing.T) {
+	assert.NoError(t, DefaultOptions().Validate())
+
+	opts := DefaultOptions()
+	opts.Wordlist = []string{"only", "two"}
+	assert.Error(t, opts.Validate(), "two words cannot meet the minimum entropy")
+
+	opts.MinPhraseEntropy = 0
+	assert.NoError(t, opts.Validate())
+
+	opts.Wordlist = []string{"one", "has-separator"}
+	assert.Error(t, opts.Validate())
+
+	opts = DefaultOptions()
+	opts.Limits.Lookups.Rate = 0
+	assert.Error(t, opts.Validate())
+
+	opts = DefaultOptions()
+	opts.Limits.Lookups.MaxLockout = opts.Limits.Lookups.BaseLockout / 2
+	assert.Error(t, opts.Validate())
+}
+
+func TestOriginAllowed(t *testing.T) {
+	r := newTestRelay(t)
+	assert.True(t, r.originAllowed("https://anywhere.example"))
+
+	r = newTestRelay(t, func(o *Options) { o.AllowedOrigins = []string{"https://adit.example.com"} })
+	assert.True(t, r.originAllowed(""), "clients without an origin should be allowed")
+	assert.True(t, r.originAllowed("https://ADIT.example.com"))
+	assert.False(t, r.originAllowed("https://evil.example"))
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+)
+
+var (
+	errInvalidResumeToken = errors.New("resume token does not match")
+	errSuperseded         = errors.New("session was resumed by another connection")
+)
+
+// newResumeToken returns a random token for the sender and the hash of it
+// which is stored in the session
+func newResumeToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashResumeToken(token), nil
+}
+
+func hashResumeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendPhraseCreate tells the sender its phrase, along with the token to
+// resume the session when the client supports it
+func (p *peer) sendPhraseCreate(phrase, resumeToken string) {
+	var content any = phrase
+	if p.supports(protocol.CapResume) {
+		content = &protocol.PhraseCreated{Phrase: phrase, ResumeToken: resumeToken}
+	}
+	p.sendMessage(&protocol.Message{
+		MessageType: protocol.TypePhraseCreate,
+		Phrase:      phrase,
+		Content:     content,
+	})
+}
+
+// resume reconnects a sender to the session it lost its connection to. The
+// answer is sent again if the collector has already replied, as it may have
+// been lost along with the connection.
+func (p *peer) resume(ctx context.Context, msg *protocol.Message) {
+	if p.relay.draining.Load() {
+		p.sendError(protocol.CodeServerDraining, "relay server is shutting down, retry to reach another instance", true)
+		return
+	}
+	token, ok := msg.Content.(string)
+	if msg.Phrase == "" || !ok || token == "" {
+		p.sendError(protocol.CodeMalformedMessage, "a phrase and resume token are required to resume", false)
+		return
+	}
+	if phrase, _ := p.session(); phrase != "" {
+		p.sendError(protocol.CodeMalformedMessage, "already a member of a session", false)
+		return
+	}
+
+	// taking a new epoch first stops the old connection, which may not have
+	// been noticed as lost yet, from changing the session when it closes
+	s, err := p.relay.store.Update(ctx, msg.Phrase, func(s *Session) error {
+		if s.ResumeTokenHash == "" || subtle.ConstantTimeCompare([]byte(hashResumeToken(token)), []byte(s.ResumeTokenHash)) != 1 {
+			return errInvalidResumeToken
+		}
+		s.SenderEpoch++
+		return nil
+	})
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		// only a sender resumes, which should not be told to check a code
+		// it was given
+		p.sendError(protocol.CodeSessionExpired, "the session expired before it could be resumed", false)
+		return
+	case errors.Is(err, errInvalidResumeToken):
+		p.sendError(protocol.CodeNotSessionMember, "resume token does not match", false)
+		return
+	case err != nil:
+		p.relay.log.Error("unable to resume session", "session", p.relay.sessionID(msg.Phrase), "error", err)
+		p.sendError(protocol.CodeInternal, "unable to resume the session", true)
+		return
+	}
+	epoch := s.SenderEpoch
+
+	if err := p.join(ctx, msg.Phrase, RoleSender, epoch); err != nil {
+		p.relay.log.Error("unable to subscribe to session", "session", p.relay.sessionID(msg.Phrase), "error", err)
+		p.sendError(protocol.CodeInternal, "unable to resume the session", true)
+		return
+	}
+
+	var pending []*protocol.Message
+	s, err = p.relay.store.Update(ctx, msg.Phrase, func(s *Session) error {
+		if s.SenderEpoch != epoch {
+			return errSuperseded
+		}
+		s.SenderConnected = true
+		s.SenderLeftAt = time.Time{}
+		pending = nil
+		if s.AnswerSdp != "" {
+			pending = s.SenderCandidates
+			s.SenderCandidates = nil
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errSuperseded):
+		p.relay.log.Info("unable to resume session", "session", p.relay.sessionID(msg.Phrase), "error", err)
+		p.sendError(protocol.CodeNotSessionMember, "the session was resumed by another connection", false)
+		return
+	case err != nil:
+		p.relay.log.Info("unable to resume session", "session", p.relay.sessionID(msg.Phrase), "error", err)
+		p.sendError(protocol.CodeSessionExpired, "the session expired before it could be resumed", false)
+		return
+	}
+	p.relay.log.Info("sender resumed session", "session", p.relay.sessionID(msg.Phrase), "epoch", epoch)
+	p.relay.metrics.sessionsResumed.Inc()
+
+	p.sendPhraseCreate(msg.Phrase, token)
+	if s.AnswerSdp == "" {
+		return
+	}
+	p.sendMessage(&protocol.Message{
+		MessageType: protocol.TypeAnswer,
+		Phrase:      msg.Phrase,
+		Content:     s.AnswerSdp,
+	})
+	for _, candidate := range pending {
+		p.sendMessage(candidate)
+	}
+}
+
+// releaseHeldSession removes a session held for its sender once the resume
+// grace period has passed without the sender returning, telling the collector
+func (r *Relay) releaseHeldSession(phrase string, epoch int) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	var released bool
+	_, err := r.store.Modify(ctx, phrase, func(s *Session) (bool, error) {
+		released = s.SenderEpoch == epoch && !s.SenderConnected
+		return released, nil
+	})
+	if err != nil || !released {
+		return
+	}
+	r.log.Info("sender did not resume, removing session", "session", r.sessionID(phrase))
+	r.notifyDisconnected(ctx, phrase, RoleSender)
+}
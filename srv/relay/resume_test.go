@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dropSession creates a session and then cuts the sender's connection without
+// a close frame, returning the phrase create message it was sent
+func dropSession(t *testing.T, r *Relay) (*protocol.Message, <-chan *protocol.Message) {
+	t.Helper()
+	p, client := newTestPeer(t, r)
+	created, collector := startSession(t, p, client)
+	client.UnderlyingConn().Close()
+
+	require.Eventually(t, func() bool {
+		s, err := r.store.Get(context.Background(), created.Phrase)
+		return err == nil && !s.SenderConnected
+	}, 2*time.Second, 10*time.Millisecond)
+	return created, collector
+}
+
+func TestSenderResumesSession(t *testing.T) {
+	r := newTestRelay(t)
+	created, _ := dropSession(t, r)
+
+	var phraseCreated protocol.PhraseCreated
+	require.NoError(t, created.DecodeContent(&phraseCreated))
+	assert.Equal(t, created.Phrase, phraseCreated.Phrase)
+	require.NotEmpty(t, phraseCreated.ResumeToken)
+
+	// the collector answers while the sender is away
+	collector, collectorClient := newTestPeer(t, r)
+	handle(t, collector, collectorClient, hello())
+	offer := handle(t, collector, collectorClient, &protocol.Message{MessageType: protocol.TypeGetOffer, Phrase: created.Phrase})
+	require.Equal(t, protocol.TypeOffer, offer.MessageType)
+	answer, err := json.Marshal(&protocol.Message{MessageType: protocol.TypeAnswer, Phrase: created.Phrase, Content: testOfferSdp})
+	require.NoError(t, err)
+	collector.handleTextMessage(answer)
+
+	sender, senderClient := newTestPeer(t, r)
+	handle(t, sender, senderClient, hello())
+
+	reply := handle(t, sender, senderClient, &protocol.Message{MessageType: protocol.TypeResume, Phrase: created.Phrase, Content: "wrong"})
+	assert.Equal(t, protocol.CodeNotSessionMember, reply.ToError().Code)
+
+	reply = handle(t, sender, senderClient, &protocol.Message{MessageType: protocol.TypeResume, Phrase: created.Phrase, Content: phraseCreated.ResumeToken})
+	require.Equal(t, protocol.TypePhraseCreate, reply.MessageType)
+	assert.Equal(t, created.Phrase, reply.Phrase)
+
+	reply = &protocol.Message{}
+	require.NoError(t, senderClient.ReadJSON(reply))
+	assert.Equal(t, protocol.TypeAnswer, reply.MessageType)
+	assert.Equal(t, testOfferSdp, reply.Content)
+
+	s, err := r.store.Get(context.Background(), created.Phrase)
+	require.NoError(t, err)
+	assert.True(t, s.SenderConnected)
+	assert.True(t, s.SenderLeftAt.IsZero())
+	assert.Equal(t, 1, s.SenderEpoch)
+}
+
+func TestHeldSessionReleasedAfterGrace(t *testing.T) {
+	r := newTestRelay(t, func(o *Options) { o.ResumeGrace = 100 * time.Millisecond })
+	created, collector := dropSession(t, r)
+
+	select {
+	case m := <-collector:
+		assert.Equal(t, protocol.TypePeerDisconnected, m.MessageType)
+		assert.Equal(t, string(RoleSender), m.Content)
+	case <-time.After(2 * time.Second):
+		t.Fatal("collector was not told the sender disconnected")
+	}
+	_, err := r.store.Get(context.Background(), created.Phrase)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
+
+func TestResumeExpiredSession(t *testing.T) {
+	r := newTestRelay(t, func(o *Options) { o.ResumeGrace = 100 * time.Millisecond })
+	created, _ := dropSession(t, r)
+	var phraseCreated protocol.PhraseCreated
+	require.NoError(t, created.DecodeContent(&phraseCreated))
+	require.Eventually(t, func() bool {
+		_, err := r.store.Get(context.Background(), created.Phrase)
+		return errors.Is(err, ErrSessionNotFound)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	sender, senderClient := newTestPeer(t, r)
+	handle(t, sender, senderClient, hello())
+	reply := handle(t, sender, senderClient, &protocol.Message{MessageType: protocol.TypeResume, Phrase: created.Phrase, Content: phraseCreated.ResumeToken})
+	assert.Equal(t, protocol.CodeSessionExpired, reply.ToError().Code, "the sender should not be told to check the code")
+}
+
+func TestResumeRequiresCapability(t *testing.T) {
+	r := newTestRelay(t)
+	p, client := newTestPeer(t, r)
+	handle(t, p, client, &protocol.Message{MessageType: protocol.TypePing, Content: &protocol.Hello{Version: protocol.Version}})
+
+	created := handle(t, p, client, &protocol.Message{MessageType: protocol.TypeOffer, Content: testOfferSdp})
+	require.Equal(t, protocol.TypePhraseCreate, created.MessageType)
+	assert.Equal(t, created.Phrase, created.Content, "older clients are sent the phrase as the content")
+
+	s, err := r.store.Get(context.Background(), created.Phrase)
+	require.NoError(t, err)
+	assert.Empty(t, s.ResumeTokenHash)
+}
+
+func TestResumeTokenIsNotLogged(t *testing.T) {
+	var logs lockedBuffer
+	r := newTestRelay(t, func(o *Options) {
+		o.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	})
+	created, _ := dropSession(t, r)
+	var phraseCreated protocol.PhraseCreated
+	require.NoError(t, created.DecodeContent(&phraseCreated))
+	require.NotEmpty(t, phraseCreated.ResumeToken)
+
+	// resuming has the token in the message received and the one sent back
+	sender, senderClient := newTestPeer(t, r)
+	handle(t, sender, senderClient, hello())
+	reply := handle(t, sender, senderClient, &protocol.Message{MessageType: protocol.TypeResume, Phrase: created.Phrase, Content: phraseCreated.ResumeToken})
+	require.Equal(t, protocol.TypePhraseCreate, reply.MessageType)
+
+	assert.Contains(t, logs.String(), "message sent to")
+	assert.Contains(t, logs.String(), "[redacted]")
+	assert.NotContains(t, logs.String(), phraseCreated.ResumeToken, "the resume token should not be logged")
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func (r *Relay) trackPeer(p *peer) {
+	r.peersMu.Lock()
+	defer r.peersMu.Unlock()
+	r.peers[p] = struct{}{}
+}
+
+func (r *Relay) untrackPeer(p *peer) {
+	r.peersMu.Lock()
+	defer r.peersMu.Unlock()
+	delete(r.peers, p)
+}
+
+// localPhrases returns the sessions joined by peers connected to this
+// instance
+func (r *Relay) localPhrases() []string {
+	r.peersMu.Lock()
+	defer r.peersMu.Unlock()
+	seen := make(map[string]bool)
+	var phrases []string
+	for p := range r.peers {
+		phrase, _ := p.session()
+		if phrase != "" && !seen[phrase] {
+			seen[phrase] = true
+			phrases = append(phrases, phrase)
+		}
+	}
+	return phrases
+}
+
+// Drain stops new sessions being created and waits until the sessions in
+// progress have finished pairing or ctx is done. Connections are left open
+// until Close.
+func (r *Relay) Drain(ctx context.Context) {
+	r.draining.Store(true)
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for len(r.localPhrases()) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the relay's background work and closes every remaining
+// connection telling the client to retry. The store is not closed.
+func (r *Relay) Close() error {
+	r.stop()
+
+	r.peersMu.Lock()
+	defer r.peersMu.Unlock()
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server shutting down, retry")
+	for p := range r.peers {
+		p.writeMu.Lock()
+		p.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		p.writeMu.Unlock()
+		p.Close()
+	}
+	r.log.Info("relay closed", "closedConnections", len(r.peers))
+	return nil
+}
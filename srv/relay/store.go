@@ -0,0 +1,301 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExists   = errors.New("session already exists")
+	ErrSessionClaimed  = errors.New("session already claimed by a collector")
+)
+
+// Role identifies which side of a session a peer is on
+type Role string
+
+const (
+	RoleSender    Role = "sender"
+	RoleCollector Role = "collector"
+)
+
+// Session is the state shared by the two peers exchanging a file. It holds
+// no connections so it can be stored outside of the process, the peers
+// themselves may be connected to different relay instances.
+type Session struct {
+	Phrase    string    `json:"phrase"`
+	CreatedAt time.Time `json:"createdAt"`
+	OfferSdp  string    `json:"offerSdp"`
+	AnswerSdp string    `json:"answerSdp,omitempty"`
+	// SenderConnected and CollectorConnected are set while each peer has a
+	// websocket open to one of the relay instances
+	SenderConnected    bool `json:"senderConnected"`
+	CollectorConnected bool `json:"collectorConnected"`
+	// ResumeTokenHash is the SHA-256 of the token issued to the sender, which
+	// it presents to reclaim the session after losing its connection
+	ResumeTokenHash string `json:"resumeTokenHash,omitempty"`
+	// SenderEpoch counts the sender's connections, a connection which has
+	// been replaced by a resumed one no longer affects the session
+	SenderEpoch int `json:"senderEpoch"`
+	// SenderLeftAt is set while the session is held for the sender to resume
+	SenderLeftAt time.Time `json:"senderLeftAt"`
+	// CollectorClaimed is set once a collector has joined, it is never
+	// cleared so a phrase can only be collected once
+	CollectorClaimed bool `json:"collectorClaimed"`
+	// FailedLookups counts lookups of other phrases which share this
+	// session's lookupPrefix, its nameplate and first word
+	FailedLookups int `json:"failedLookups"`
+	// SenderCandidateCount and CollectorCandidateCount are the number of
+	// candidates each peer has sent, limited by Config.MaxCandidates
+	SenderCandidateCount    int `json:"senderCandidateCount"`
+	CollectorCandidateCount int `json:"collectorCandidateCount"`
+	// ICE candidates which arrived before the peer they are addressed to
+	// was ready for them, replayed in order once it is
+	SenderCandidates    []*protocol.Message `json:"senderCandidates,omitempty"`
+	CollectorCandidates []*protocol.Message `json:"collectorCandidates,omitempty"`
+}
+
+// SessionStore holds the sessions and routes messages between peers, which
+// may be connected to different relay instances
+type SessionStore interface {
+	// Create stores a new session, returning ErrSessionExists if the phrase
+	// is already in use or, for a phrase with a phraseNameplate, another live
+	// phrase has the same nameplate. The check and the creation are atomic,
+	// so relays generating phrases at once cannot share a nameplate.
+	Create(ctx context.Context, s *Session) error
+	Get(ctx context.Context, phrase string) (*Session, error)
+	// Update applies fn to the session atomically and stores the result. If
+	// fn returns an error the session is left unchanged.
+	Update(ctx context.Context, phrase string, fn func(*Session) error) (*Session, error)
+	// Modify is Update where fn may also ask for the session to be deleted
+	// by returning true
+	Modify(ctx context.Context, phrase string, fn func(*Session) (bool, error)) (*Session, error)
+	Delete(ctx context.Context, phrase string) error
+	// PhrasesWithPrefix lists the live phrases whose nameplate, or first word
+	// when they have none, is prefix
+	PhrasesWithPrefix(ctx context.Context, prefix string) ([]string, error)
+	Count(ctx context.Context) (int, error)
+
+	// Publish sends a message to the peer with the given role in a session,
+	// wherever it is connected. Messages for peers which are not subscribed
+	// are dropped.
+	Publish(ctx context.Context, phrase string, to Role, msg *protocol.Message) error
+	// Subscribe delivers messages published to the role in a session until
+	// the returned function is called
+	Subscribe(ctx context.Context, phrase string, role Role, deliver func(*protocol.Message)) (func(), error)
+	Close() error
+}
+
+// claimCollector reserves the session for a collector, for use with Update.
+// The collector is only marked as connected once it has subscribed, until
+// then the sender's candidates are queued for it.
+func claimCollector(s *Session) error {
+	if s.CollectorClaimed {
+		return ErrSessionClaimed
+	}
+	s.CollectorClaimed = true
+	return nil
+}
+
+// countCandidate records a candidate sent by role, returning
+// errTooManyCandidates once it has sent more than max
+func (s *Session) countCandidate(role Role, max int) error {
+	count := &s.SenderCandidateCount
+	if role == RoleCollector {
+		count = &s.CollectorCandidateCount
+	}
+	if *count >= max {
+		return errTooManyCandidates
+	}
+	*count++
+	return nil
+}
+
+// other returns the role of the other peer in a session
+func (r Role) other() Role {
+	if r == RoleSender {
+		return RoleCollector
+	}
+	return RoleSender
+}
+
+func channelName(phrase string, role Role) string {
+	return phrase + "/" + string(role)
+}
+
+// memoryStore is a SessionStore for a single relay instance
+type memoryStore struct {
+	mu          sync.Mutex
+	sessions    map[string]*Session
+	subscribers map[string]*subscription
+}
+
+// subscription is compared by pointer so that cancelling an old
+// subscription does not remove a newer one for the same channel
+type subscription struct {
+	deliver func(*protocol.Message)
+}
+
+// NewMemoryStore returns a SessionStore which keeps sessions in memory, so
+// the sender and collector must connect to the same relay
+func NewMemoryStore() SessionStore {
+	return &memoryStore{
+		sessions:    make(map[string]*Session),
+		subscribers: make(map[string]*subscription),
+	}
+}
+
+func (m *memoryStore) Create(_ context.Context, s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[s.Phrase]; ok {
+		return ErrSessionExists
+	}
+	if nameplate := phraseNameplate(s.Phrase); nameplate != "" {
+		for phrase := range m.sessions {
+			if phrasePrefix(phrase) == nameplate {
+				return ErrSessionExists
+			}
+		}
+	}
+	m.sessions[s.Phrase] = cloneSession(s)
+	return nil
+}
+
+func (m *memoryStore) Get(_ context.Context, phrase string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[phrase]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return cloneSession(s), nil
+}
+
+func (m *memoryStore) Update(ctx context.Context, phrase string, fn func(*Session) error) (*Session, error) {
+	return m.Modify(ctx, phrase, func(s *Session) (bool, error) {
+		return false, fn(s)
+	})
+}
+
+func (m *memoryStore) Modify(_ context.Context, phrase string, fn func(*Session) (bool, error)) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[phrase]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	updated := cloneSession(s)
+	remove, err := fn(updated)
+	if err != nil {
+		return nil, err
+	}
+	if remove {
+		delete(m.sessions, phrase)
+	} else {
+		m.sessions[phrase] = updated
+	}
+	return cloneSession(updated), nil
+}
+
+func (m *memoryStore) Delete(_ context.Context, phrase string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, phrase)
+	return nil
+}
+
+func (m *memoryStore) PhrasesWithPrefix(_ context.Context, prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var phrases []string
+	for phrase := range m.sessions {
+		if phrasePrefix(phrase) == prefix {
+			phrases = append(phrases, phrase)
+		}
+	}
+	return phrases, nil
+}
+
+func (m *memoryStore) Count(_ context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions), nil
+}
+
+func (m *memoryStore) Publish(_ context.Context, phrase string, to Role, msg *protocol.Message) error {
+	m.mu.Lock()
+	sub, ok := m.subscribers[channelName(phrase, to)]
+	m.mu.Unlock()
+	if ok {
+		sub.deliver(msg)
+	}
+	return nil
+}
+
+func (m *memoryStore) Subscribe(_ context.Context, phrase string, role Role, deliver func(*protocol.Message)) (func(), error) {
+	channel := channelName(phrase, role)
+	sub := &subscription{deliver: deliver}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers[channel] = sub
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.subscribers[channel] == sub {
+			delete(m.subscribers, channel)
+		}
+	}, nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// cloneSession copies a session so callers cannot modify stored state
+// without going through Update
+func cloneSession(s *Session) *Session {
+	c := *s
+	c.SenderCandidates = append([]*protocol.Message(nil), s.SenderCandidates...)
+	c.CollectorCandidates = append([]*protocol.Message(nil), s.CollectorCandidates...)
+	return &c
+}
+
+// phrasePrefix returns the nameplate of a phrase, or the first word of a
+// phrase without one
+func phrasePrefix(phrase string) string {
+	if i := strings.IndexFunc(phrase, protocol.IsPhraseSeparator); i != -1 {
+		return phrase[:i]
+	}
+	return phrase
+}
+
+// phraseNameplate returns the number a phrase starts with, such as 7 for
+// 7-chosen-murmuring, or "" when it does not start with one
+func phraseNameplate(phrase string) string {
+	nameplate := phrasePrefix(phrase)
+	if !isNumber(nameplate) || len(nameplate) == len(phrase) {
+		return ""
+	}
+	return nameplate
+}
+
+// lookupPrefix returns the part of a phrase failed lookups are counted
+// against, the nameplate and first word of a phrase with a nameplate or the
+// first word of one without. The nameplate alone is not enough, generated
+// nameplates are drawn from so few numbers that a handful of misses for
+// each would invalidate every session.
+func lookupPrefix(phrase string) string {
+	nameplate := phraseNameplate(phrase)
+	if nameplate == "" {
+		return phrasePrefix(phrase)
+	}
+	rest := phrase[len(nameplate)+1:]
+	return phrase[:len(nameplate)+1+len(phrasePrefix(rest))]
+}
@@ -0,0 +1,291 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisSessionPrefix = "adit:session:"
+	redisChannelPrefix = "adit:peer:"
+	// redisSessionsKey and the keys under redisPrefixPrefix index the live
+	// sessions, and those with each phrasePrefix, in sorted sets scored by
+	// when their session key expires, so neither needs a scan of every key
+	redisSessionsKey  = "adit:sessions"
+	redisPrefixPrefix = "adit:prefix:"
+	// redisMaxRetries bounds the optimistic transaction retries when several
+	// instances update a session at once
+	redisMaxRetries = 10
+)
+
+// redisStore is a SessionStore shared by every relay instance connected to
+// the same Redis server. Sessions are stored as JSON and messages for peers
+// are routed over pub/sub to whichever instance they are connected to.
+type redisStore struct {
+	client *redis.Client
+	log    *slog.Logger
+	// keyTTL expires sessions left behind by an instance which stopped
+	// without cleaning up
+	keyTTL time.Duration
+
+	pubsub      *redis.PubSub
+	mu          sync.Mutex
+	subscribers map[string]*subscription
+}
+
+// NewRedisStore connects to the Redis server at url, such as
+// redis://localhost:6379/0. It logs to logger, which should be the relay's,
+// or slog.Default() when nil.
+func NewRedisStore(ctx context.Context, url string, sessionTTL time.Duration, logger *slog.Logger) (SessionStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	return newRedisStoreFromClient(ctx, redis.NewClient(opts), sessionTTL, logger)
+}
+
+func newRedisStoreFromClient(ctx context.Context, client *redis.Client, sessionTTL time.Duration, logger *slog.Logger) (*redisStore, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("unable to reach redis: %w", err)
+	}
+
+	r := &redisStore{
+		client:      client,
+		log:         logger,
+		keyTTL:      2 * sessionTTL,
+		pubsub:      client.Subscribe(ctx),
+		subscribers: make(map[string]*subscription),
+	}
+	go r.dispatch()
+	return r, nil
+}
+
+// dispatch delivers messages from the pub/sub connection to the local
+// subscribers until the store is closed
+func (r *redisStore) dispatch() {
+	for m := range r.pubsub.Channel() {
+		r.mu.Lock()
+		sub, ok := r.subscribers[strings.TrimPrefix(m.Channel, redisChannelPrefix)]
+		r.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		msg := &protocol.Message{}
+		if err := json.Unmarshal([]byte(m.Payload), msg); err != nil {
+			r.log.Error("unable to decode message from redis", "channel", m.Channel, "error", err)
+			continue
+		}
+		sub.deliver(msg)
+	}
+}
+
+func sessionKey(phrase string) string {
+	return redisSessionPrefix + phrase
+}
+
+func prefixKey(prefix string) string {
+	return redisPrefixPrefix + prefix
+}
+
+// createScript stores a session which does not exist yet and adds it to the
+// indexes, which expire along with the last session added to them. When
+// ARGV[5] is set the session's nameplate must not be used by another
+// session whose key has not expired.
+var createScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+if ARGV[5] ~= '' and redis.call('ZCOUNT', KEYS[3], '(' .. ARGV[5], '+inf') > 0 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+for i = 2, 3 do
+	redis.call('ZADD', KEYS[i], ARGV[4], ARGV[1])
+	redis.call('PEXPIRE', KEYS[i], ARGV[3])
+end
+return 1
+`)
+
+func (r *redisStore) Create(ctx context.Context, s *Session) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	keys := []string{sessionKey(s.Phrase), redisSessionsKey, prefixKey(phrasePrefix(s.Phrase))}
+	now := time.Now()
+	var uniqueAfter string
+	if phraseNameplate(s.Phrase) != "" {
+		uniqueAfter = strconv.FormatInt(now.UnixMilli(), 10)
+	}
+	expires := now.Add(r.keyTTL).UnixMilli()
+	created, err := createScript.Run(ctx, r.client, keys, s.Phrase, data, r.keyTTL.Milliseconds(), expires, uniqueAfter).Int()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		return ErrSessionExists
+	}
+	return nil
+}
+
+// remove queues the deletion of a session and its index entries
+func remove(ctx context.Context, pipe redis.Pipeliner, phrase string) {
+	pipe.Del(ctx, sessionKey(phrase))
+	pipe.ZRem(ctx, redisSessionsKey, phrase)
+	pipe.ZRem(ctx, prefixKey(phrasePrefix(phrase)), phrase)
+}
+
+func (r *redisStore) Get(ctx context.Context, phrase string) (*Session, error) {
+	return r.get(ctx, r.client, phrase)
+}
+
+func (r *redisStore) get(ctx context.Context, c redis.Cmdable, phrase string) (*Session, error) {
+	data, err := c.Get(ctx, sessionKey(phrase)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("unable to decode session: %w", err)
+	}
+	return s, nil
+}
+
+// Modify runs fn in an optimistic transaction, retrying if another instance
+// changed the session first
+func (r *redisStore) Modify(ctx context.Context, phrase string, fn func(*Session) (bool, error)) (*Session, error) {
+	key := sessionKey(phrase)
+	var result *Session
+
+	txf := func(tx *redis.Tx) error {
+		s, err := r.get(ctx, tx, phrase)
+		if err != nil {
+			return err
+		}
+		removed, err := fn(s)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if removed {
+				remove(ctx, pipe, phrase)
+			} else {
+				pipe.Set(ctx, key, data, redis.KeepTTL)
+			}
+			return nil
+		})
+		result = s
+		return err
+	}
+
+	for i := 0; i < redisMaxRetries; i++ {
+		err := r.client.Watch(ctx, txf, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("session %s is too busy to update", phrase)
+}
+
+func (r *redisStore) Update(ctx context.Context, phrase string, fn func(*Session) error) (*Session, error) {
+	return r.Modify(ctx, phrase, func(s *Session) (bool, error) {
+		return false, fn(s)
+	})
+}
+
+func (r *redisStore) Delete(ctx context.Context, phrase string) error {
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		remove(ctx, pipe, phrase)
+		return nil
+	})
+	return err
+}
+
+func (r *redisStore) PhrasesWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return r.client.ZRangeByScore(ctx, prefixKey(prefix), &redis.ZRangeBy{Min: "(" + now, Max: "+inf"}).Result()
+}
+
+// Count also drops sessions whose keys expired from the index, which are
+// those left behind by an instance which stopped without cleaning up
+func (r *redisStore) Count(ctx context.Context) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	var count *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, redisSessionsKey, "-inf", now)
+		count = pipe.ZCard(ctx, redisSessionsKey)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count.Val()), nil
+}
+
+func (r *redisStore) Publish(ctx context.Context, phrase string, to Role, msg *protocol.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, redisChannelPrefix+channelName(phrase, to), data).Err()
+}
+
+func (r *redisStore) Subscribe(ctx context.Context, phrase string, role Role, deliver func(*protocol.Message)) (func(), error) {
+	channel := channelName(phrase, role)
+	sub := &subscription{deliver: deliver}
+
+	r.mu.Lock()
+	r.subscribers[channel] = sub
+	r.mu.Unlock()
+
+	if err := r.pubsub.Subscribe(ctx, redisChannelPrefix+channel); err != nil {
+		r.mu.Lock()
+		delete(r.subscribers, channel)
+		r.mu.Unlock()
+		return nil, err
+	}
+
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.subscribers[channel] != sub {
+			return
+		}
+		delete(r.subscribers, channel)
+		if err := r.pubsub.Unsubscribe(context.Background(), redisChannelPrefix+channel); err != nil {
+			r.log.Error("unable to unsubscribe from redis channel", "channel", channel, "error", err)
+		}
+	}, nil
+}
+
+func (r *redisStore) Close() error {
+	return errors.Join(r.pubsub.Close(), r.client.Close())
+}
@@ -0,0 +1,327 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRedisStore returns a redisStore backed by server, or by a new
+// in-process Redis server when server is nil
+func newTestRedisStore(t *testing.T, server *miniredis.Miniredis) *redisStore {
+	t.Helper()
+	if server == nil {
+		server = miniredis.RunT(t)
+	}
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store, err := newRedisStoreFromClient(context.Background(), client, time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testStores runs a test against every SessionStore implementation
+func testStores(t *testing.T, test func(t *testing.T, store SessionStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+	t.Run("redis", func(t *testing.T) {
+		test(t, newTestRedisStore(t, nil))
+	})
+}
+
+func TestStoreCreateAndGet(t *testing.T) {
+	testStores(t, func(t *testing.T, store SessionStore) {
+		ctx := context.Background()
+		created := time.Now().Truncate(time.Second)
+		require.NoError(t, store.Create(ctx, &Session{Phrase: "apple.banana", CreatedAt: created, OfferSdp: "offer", SenderConnected: true}))
+
+		s, err := store.Get(ctx, "apple.banana")
+		require.NoError(t, err)
+		assert.Equal(t, "offer", s.OfferSdp)
+		assert.True(t, s.CreatedAt.Equal(created))
+		assert.True(t, s.SenderConnected)
+
+		err = store.Create(ctx, &Session{Phrase: "apple.banana"})
+		assert.ErrorIs(t, err, ErrSessionExists)
+
+		_, err = store.Get(ctx, "cherry.banana")
+		assert.ErrorIs(t, err, ErrSessionNotFound)
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	testStores(t, func(t *testing.T, store SessionStore) {
+		ctx := context.Background()
+		require.NoError(t, store.Create(ctx, &Session{Phrase: "apple.banana"}))
+
+		s, err := store.Update(ctx, "apple.banana", claimCollector)
+		require.NoError(t, err)
+		assert.True(t, s.CollectorClaimed)
+
+		_, err = store.Update(ctx, "apple.banana", claimCollector)
+		assert.ErrorIs(t, err, ErrSessionClaimed)
+
+		candidate := &protocol.Message{MessageType: protocol.TypeICECandidate, Phrase: "apple.banana", Content: "candidate"}
+		_, err = store.Update(ctx, "apple.banana", func(s *Session) error {
+			s.SenderCandidates = append(s.SenderCandidates, candidate)
+			return nil
+		})
+		require.NoError(t, err)
+
+		s, err = store.Get(ctx, "apple.banana")
+		require.NoError(t, err)
+		require.Len(t, s.SenderCandidates, 1)
+		assert.Equal(t, "candidate", s.SenderCandidates[0].Content)
+
+		_, err = store.Update(ctx, "cherry.banana", claimCollector)
+		assert.ErrorIs(t, err, ErrSessionNotFound)
+	})
+}
+
+func TestStoreModify(t *testing.T) {
+	testStores(t, func(t *testing.T, store SessionStore) {
+		ctx := context.Background()
+		require.NoError(t, store.Create(ctx, &Session{Phrase: "apple.banana", SenderConnected: true}))
+
+		s, err := store.Modify(ctx, "apple.banana", func(s *Session) (bool, error) {
+			s.SenderConnected = false
+			return false, nil
+		})
+		require.NoError(t, err)
+		assert.False(t, s.SenderConnected)
+		_, err = store.Get(ctx, "apple.banana")
+		assert.NoError(t, err)
+
+		_, err = store.Modify(ctx, "apple.banana", func(s *Session) (bool, error) {
+			return true, nil
+		})
+		require.NoError(t, err)
+		_, err = store.Get(ctx, "apple.banana")
+		assert.ErrorIs(t, err, ErrSessionNotFound)
+	})
+}
+
+func TestStorePhrasesWithPrefixAndCount(t *testing.T) {
+	testStores(t, func(t *testing.T, store SessionStore) {
+		ctx := context.Background()
+		for _, phrase := range []string{"apple.banana", "apple.cherry", "applesauce.banana", "cherry.apple", "7-apple-banana", "70-apple-banana"} {
+			require.NoError(t, store.Create(ctx, &Session{Phrase: phrase}))
+		}
+
+		phrases, err := store.PhrasesWithPrefix(ctx, "apple")
+		require.NoError(t, err)
+		sort.Strings(phrases)
+		assert.Equal(t, []string{"apple.banana", "apple.cherry"}, phrases)
+
+		phrases, err = store.PhrasesWithPrefix(ctx, "7")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"7-apple-banana"}, phrases)
+
+		count, err := store.Count(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 6, count)
+
+		require.NoError(t, store.Delete(ctx, "apple.banana"))
+		count, err = store.Count(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 5, count)
+	})
+}
+
+func TestStoreCreateReservesNameplate(t *testing.T) {
+	testStores(t, func(t *testing.T, store SessionStore) {
+		ctx := context.Background()
+		require.NoError(t, store.Create(ctx, &Session{Phrase: "7-apple-banana"}))
+		assert.ErrorIs(t, store.Create(ctx, &Session{Phrase: "7-cherry-apple"}), ErrSessionExists)
+		assert.NoError(t, store.Create(ctx, &Session{Phrase: "70-cherry-apple"}))
+
+		require.NoError(t, store.Delete(ctx, "7-apple-banana"))
+		assert.NoError(t, store.Create(ctx, &Session{Phrase: "7-cherry-apple"}))
+	})
+}
+
+func TestRedisStoreNameplateRace(t *testing.T) {
+	server := miniredis.RunT(t)
+	stores := []*redisStore{newTestRedisStore(t, server), newTestRedisStore(t, server)}
+	ctx := context.Background()
+
+	errs := make(chan error, 2*len(stores)*10)
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		for j := range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- store.Create(ctx, &Session{Phrase: fmt.Sprintf("7-apple-%d-%d", i, j)})
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrSessionExists)
+	}
+	assert.Equal(t, 1, created, "only one session may have the nameplate")
+}
+
+func TestStorePublishSubscribe(t *testing.T) {
+	testStores(t, func(t *testing.T, store SessionStore) {
+		ctx := context.Background()
+		received := make(chan *protocol.Message, 1)
+		unsubscribe, err := store.Subscribe(ctx, "apple.banana", RoleSender, func(m *protocol.Message) {
+			received <- m
+		})
+		require.NoError(t, err)
+
+		// redis confirms subscriptions asynchronously
+		assert.Eventually(t, func() bool {
+			require.NoError(t, store.Publish(ctx, "apple.banana", RoleSender, &protocol.Message{MessageType: protocol.TypeAnswer, Content: "answer"}))
+			select {
+			case m := <-received:
+				return assert.Equal(t, "answer", m.Content)
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}, 2*time.Second, 10*time.Millisecond)
+
+		require.NoError(t, store.Publish(ctx, "apple.banana", RoleCollector, &protocol.Message{MessageType: protocol.TypeOffer}))
+		unsubscribe()
+		require.NoError(t, store.Publish(ctx, "apple.banana", RoleSender, &protocol.Message{MessageType: protocol.TypeAnswer}))
+
+		select {
+		case m := <-received:
+			t.Fatalf("unexpected message delivered: %+v", m)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestStoreUnsubscribeKeepsNewerSubscription(t *testing.T) {
+	testStores(t, func(t *testing.T, store SessionStore) {
+		ctx := context.Background()
+		unsubscribeOld, err := store.Subscribe(ctx, "apple.banana", RoleSender, func(*protocol.Message) {})
+		require.NoError(t, err)
+
+		received := make(chan *protocol.Message, 10)
+		_, err = store.Subscribe(ctx, "apple.banana", RoleSender, func(m *protocol.Message) {
+			received <- m
+		})
+		require.NoError(t, err)
+		unsubscribeOld()
+
+		assert.Eventually(t, func() bool {
+			require.NoError(t, store.Publish(ctx, "apple.banana", RoleSender, &protocol.Message{MessageType: protocol.TypeAnswer}))
+			select {
+			case <-received:
+				return true
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestRedisStoreRoutesBetweenInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestRedisStore(t, server)
+	second := newTestRedisStore(t, server)
+	ctx := context.Background()
+
+	require.NoError(t, first.Create(ctx, &Session{Phrase: "apple.banana", OfferSdp: "offer", SenderConnected: true}))
+	received := make(chan *protocol.Message, 1)
+	_, err := first.Subscribe(ctx, "apple.banana", RoleSender, func(m *protocol.Message) {
+		received <- m
+	})
+	require.NoError(t, err)
+
+	// the collector connects to the second instance
+	s, err := second.Update(ctx, "apple.banana", claimCollector)
+	require.NoError(t, err)
+	assert.Equal(t, "offer", s.OfferSdp)
+
+	assert.Eventually(t, func() bool {
+		require.NoError(t, second.Publish(ctx, "apple.banana", RoleSender, &protocol.Message{MessageType: protocol.TypeAnswer, Content: "answer"}))
+		select {
+		case m := <-received:
+			return assert.Equal(t, "answer", m.Content)
+		case <-time.After(50 * time.Millisecond):
+			return false
+		}
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRedisStoreSessionKeyExpires(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newTestRedisStore(t, server)
+	ctx := context.Background()
+
+	require.NoError(t, store.Create(ctx, &Session{Phrase: "apple.banana"}))
+	_, err := store.Update(ctx, "apple.banana", claimCollector)
+	require.NoError(t, err)
+
+	// updates keep the expiry set when the session was created
+	server.FastForward(store.keyTTL)
+	_, err = store.Get(ctx, "apple.banana")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
+
+func TestRedisStoreIndexesLiveSessions(t *testing.T) {
+	store := newTestRedisStore(t, nil)
+	ctx := context.Background()
+	require.NoError(t, store.Create(ctx, &Session{Phrase: "apple.banana"}))
+	require.NoError(t, store.Create(ctx, &Session{Phrase: "apple.cherry"}))
+	_, err := store.Modify(ctx, "apple.cherry", func(*Session) (bool, error) { return true, nil })
+	require.NoError(t, err)
+
+	phrases, err := store.PhrasesWithPrefix(ctx, "apple")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"apple.banana"}, phrases, "removed sessions should leave the index")
+
+	// a session whose key expired, as one left by an instance which stopped
+	// does, is no longer counted
+	store.keyTTL = 50 * time.Millisecond
+	require.NoError(t, store.Create(ctx, &Session{Phrase: "cherry.apple"}))
+	time.Sleep(2 * store.keyTTL)
+	phrases, err = store.PhrasesWithPrefix(ctx, "cherry")
+	require.NoError(t, err)
+	assert.Empty(t, phrases)
+	count, err := store.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestRedisStoreLogsToItsLogger(t *testing.T) {
+	server := miniredis.RunT(t)
+	var logs lockedBuffer
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store, err := newRedisStoreFromClient(context.Background(), client, time.Minute, slog.New(slog.NewTextHandler(&logs, nil)))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	ctx := context.Background()
+	_, err = store.Subscribe(ctx, "apple.banana", RoleSender, func(*protocol.Message) {})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		require.NoError(t, client.Publish(ctx, redisChannelPrefix+channelName("apple.banana", RoleSender), "junk").Err())
+		return strings.Contains(logs.String(), "unable to decode message from redis")
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,68 @@
+package relay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Ryan-Har/adit/protocol"
+	"github.com/pion/sdp/v3"
+)
+
+var errTooManyCandidates = errors.New("too many ICE candidates")
+
+// validateSDP checks that the content of an offer or answer is a session
+// description a peer could use before it is stored or relayed
+func validateSDP(content any) (string, error) {
+	s, ok := content.(string)
+	if !ok || s == "" {
+		return "", errors.New("sdp must be a non empty string")
+	}
+
+	var desc sdp.SessionDescription
+	if err := desc.UnmarshalString(s); err != nil {
+		return "", fmt.Errorf("unable to parse sdp: %w", err)
+	}
+	if len(desc.MediaDescriptions) == 0 {
+		return "", errors.New("sdp has no media descriptions")
+	}
+	return s, nil
+}
+
+// validateCandidate checks that the content of an ICE candidate message is
+// the base64 encoded JSON the clients exchange
+func validateCandidate(content any) error {
+	s, ok := content.(string)
+	if !ok || s == "" {
+		return errors.New("candidate must be a non empty string")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("unable to decode candidate: %w", err)
+	}
+	var candidate struct {
+		Candidate *string `json:"candidate"`
+	}
+	if err := json.Unmarshal(decoded, &candidate); err != nil {
+		return fmt.Errorf("unable to parse candidate: %w", err)
+	}
+	if candidate.Candidate == nil {
+		return errors.New("candidate is missing")
+	}
+	return nil
+}
+
+// decodeOffer returns the content of an offer, which is either the SDP alone
+// or protocol.Offer from clients choosing their phrase
+func decodeOffer(msg *protocol.Message) (*protocol.Offer, error) {
+	if sdp, ok := msg.Content.(string); ok {
+		return &protocol.Offer{SDP: sdp}, nil
+	}
+	offer := &protocol.Offer{}
+	if err := msg.DecodeContent(offer); err != nil {
+		return nil, err
+	}
+	return offer, nil
+}
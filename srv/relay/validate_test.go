@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testOfferSdp = "v=0\r\n" +
+	"o=- 4215775240449105457 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=group:BUNDLE 0\r\n" +
+	"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=sctp-port:5000\r\n"
+
+var testCandidate = base64.StdEncoding.EncodeToString([]byte(
+	`{"candidate":"candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host","sdpMid":"0","sdpMLineIndex":0}`))
+
+func TestValidateSDP(t *testing.T) {
+	tests := []struct {
+		name    string
+		content any
+		valid   bool
+	}{
+		{"offer", testOfferSdp, true},
+		{"empty", "", false},
+		{"not a string", map[string]any{"sdp": testOfferSdp}, false},
+		{"junk", "hello there", false},
+		{"no media", "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := validateSDP(tt.content)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateCandidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content any
+		valid   bool
+	}{
+		{"candidate", testCandidate, true},
+		{"end of candidates", base64.StdEncoding.EncodeToString([]byte(`{"candidate":""}`)), true},
+		{"empty", "", false},
+		{"not base64", "candidate:1 1 udp", false},
+		{"not json", base64.StdEncoding.EncodeToString([]byte("candidate:1 1 udp")), false},
+		{"missing candidate", base64.StdEncoding.EncodeToString([]byte(`{"sdpMid":"0"}`)), false},
+		{"not a string", 42.0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCandidate(tt.content)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
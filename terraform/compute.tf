@@ -24,6 +24,15 @@ container_definitions = jsonencode([
       }
     ]
     essential = true
+    environment = [
+      {
+        # the service only accepts traffic from the load balancer, which
+        # appends the client address to X-Forwarded-For where adit-srv takes
+        # it from. Only safe as adit-srv ignores the entries before it.
+        name  = "ADIT_TRUST_PROXY"
+        value = "true"
+      }
+    ]
     logConfiguration = {
       logDriver = "awslogs"
       options = {
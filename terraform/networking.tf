@@ -62,6 +62,10 @@ resource "aws_lb" "app" {
   load_balancer_type = "application"
   security_groups    = [aws_security_group.alb_sg.id]
   subnets            = [aws_subnet.public_1.id, aws_subnet.public_2.id]
+
+  # adit-srv trusts only the last X-Forwarded-For entry, which must be the
+  # address the load balancer received the request from
+  xff_header_processing_mode = "append"
 }
 
 resource "aws_lb_listener" "http" {
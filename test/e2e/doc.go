@@ -0,0 +1,3 @@
+// Package e2e tests transfers end to end, running a relay, sender and
+// collector in one process with `go test`.
+package e2e
@@ -0,0 +1,158 @@
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Ryan-Har/adit/client/transfer"
+	"github.com/Ryan-Har/adit/srv/relay"
+	"github.com/stretchr/testify/require"
+)
+
+// transferTimeout bounds each transfer, including connecting the peers
+const transferTimeout = time.Minute
+
+// testLogger keeps the output of passing tests readable, set ADIT_E2E_LOG
+// to see the relay and client logs
+func testLogger() *slog.Logger {
+	if os.Getenv("ADIT_E2E_LOG") != "" {
+		return slog.Default()
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// startRelay serves a relay with an in-memory store for the test, returning
+// its websocket URL
+func startRelay(t *testing.T) url.URL {
+	t.Helper()
+	opts := relay.DefaultOptions()
+	opts.Logger = testLogger()
+	r, err := relay.New(opts)
+	require.NoError(t, err)
+	server := httptest.NewServer(r)
+	t.Cleanup(func() {
+		r.Close()
+		server.Close()
+	})
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	u.Scheme, u.Path = "ws", "/ws"
+	return *u
+}
+
+// peerOptions connect over loopback with host candidates only, so no STUN
+// server or other network is needed
+func peerOptions(relayURL url.URL) transfer.Options {
+	return transfer.Options{
+		Relay:           relayURL,
+		STUNServers:     []string{},
+		IncludeLoopback: true,
+		PeerTimeout:     transferTimeout,
+		Logger:          testLogger(),
+	}
+}
+
+// sendAndCollect sends the file at path from one peer to another in the same
+// process, returning the path the collector saved it to
+func sendAndCollect(t *testing.T, relayURL url.URL, path string) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+
+	src, err := transfer.OpenFile(path)
+	require.NoError(t, err)
+	defer src.Close()
+
+	codes := make(chan string, 1)
+	sendOpts := peerOptions(relayURL)
+	sendOpts.OnCode = func(code string) { codes <- code }
+	sent := make(chan error, 1)
+	go func() {
+		sent <- transfer.Send(ctx, src, sendOpts)
+	}()
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-sent:
+		t.Fatalf("sender stopped before it was given a code: %v", err)
+	}
+
+	dir := t.TempDir()
+	var verification transfer.Verification
+	receiveOpts := peerOptions(relayURL)
+	receiveOpts.OnVerified = func(v transfer.Verification) { verification = v }
+	require.NoError(t, transfer.Receive(ctx, code, transfer.DirSink{Dir: dir}, receiveOpts), "collector")
+	require.NoError(t, <-sent, "sender")
+	require.True(t, verification.Checked() && verification.OK(), "the file should be verified against the sender's hash: %+v", verification)
+	return filepath.Join(dir, filepath.Base(path))
+}
+
+func TestTransferFiles(t *testing.T) {
+	sizes := map[string]int{
+		"empty":             0,
+		"single byte":       1,
+		"single chunk":      transfer.DefaultChunkSize,
+		"odd sized":         3*transfer.DefaultChunkSize + 7,
+		"multi megabyte":    5<<20 + 3,
+		"one past a chunk":  transfer.DefaultChunkSize + 1,
+		"one short a chunk": transfer.DefaultChunkSize - 1,
+	}
+	// every transfer comes from the same address, which the relay's
+	// default lookup limits allow for
+	relayURL := startRelay(t)
+	for name, size := range sizes {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(data)
+			path := filepath.Join(t.TempDir(), "file.bin")
+			require.NoError(t, os.WriteFile(path, data, 0o644))
+
+			received, err := os.ReadFile(sendAndCollect(t, relayURL, path))
+			require.NoError(t, err)
+			require.Len(t, received, size)
+			require.True(t, bytes.Equal(data, received), "the received file differs from the one sent")
+		})
+	}
+}
+
+func TestSenderIsToldCollectorFailed(t *testing.T) {
+	relayURL := startRelay(t)
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "file.bin")
+	require.NoError(t, os.WriteFile(path, []byte("new contents"), 0o644))
+	src, err := transfer.OpenFile(path)
+	require.NoError(t, err)
+	defer src.Close()
+
+	codes := make(chan string, 1)
+	sendOpts := peerOptions(relayURL)
+	sendOpts.OnCode = func(code string) { codes <- code }
+	sent := make(chan error, 1)
+	go func() {
+		sent <- transfer.Send(ctx, src, sendOpts)
+	}()
+
+	// the collector already has the file and will not replace it
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.bin"), []byte("old contents"), 0o644))
+	sink := transfer.DirSink{Dir: dir, Overwrite: transfer.OverwriteNever}
+	err = transfer.Receive(ctx, <-codes, sink, peerOptions(relayURL))
+	require.ErrorIs(t, err, transfer.ErrFileExists)
+
+	err = <-sent
+	require.ErrorIs(t, err, transfer.ErrSaveFailed, "the sender should report the collector's failure")
+	require.ErrorContains(t, err, "a file with that name already exists")
+}